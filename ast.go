@@ -0,0 +1,200 @@
+package meval
+
+// All Expression returned by Compile implement one of the following
+// node interfaces, that lets one inspect the AST of an Expression.
+
+// A ValueNode is a literal number.
+type ValueNode interface {
+	Expression
+	// Value returns the literal value
+	Value() float64
+}
+
+// A ReferenceNode is a reference to a variable of the Context.
+type ReferenceNode interface {
+	Expression
+	// Variable returns the name of the referenced variable
+	Variable() string
+}
+
+// An OperatorNode is a prefix or a binary operator.
+type OperatorNode interface {
+	Expression
+	// Operator returns the operator token, like "+"
+	Operator() string
+	// Operands returns the operands of the operator. There is one
+	// operand for a prefix operator, two for a binary one.
+	Operands() []Expression
+}
+
+// A CallNode is a function call.
+type CallNode interface {
+	Expression
+	// Function returns the name of the function, without
+	// parenthese
+	Function() string
+	// Arguments returns the arguments of the call, in source order
+	Arguments() []Expression
+}
+
+func (e *valueExp) Value() float64 {
+	return e.value
+}
+
+func (e *refExp) Variable() string {
+	return e.variable
+}
+
+func (e *unaryExp) Operator() string {
+	return e.name
+}
+
+func (e *unaryExp) Operands() []Expression {
+	return []Expression{e.child}
+}
+
+func (e *binaryExp) Operator() string {
+	return e.name
+}
+
+func (e *binaryExp) Operands() []Expression {
+	return []Expression{e.leftChild, e.rightChild}
+}
+
+func (e *lazyBinaryExp) Operator() string {
+	return e.name
+}
+
+func (e *lazyBinaryExp) Operands() []Expression {
+	return []Expression{e.leftChild, e.rightChild}
+}
+
+func (e *nExp) Function() string {
+	return e.name
+}
+
+func (e *nExp) Arguments() []Expression {
+	return append([]Expression(nil), e.children...)
+}
+
+func (e *lazyExp) Function() string {
+	return e.name
+}
+
+func (e *lazyExp) Arguments() []Expression {
+	return append([]Expression(nil), e.children...)
+}
+
+// NewValue returns a ValueNode for v. It is meant to be used with
+// Rewrite.
+func NewValue(v float64) Expression {
+	return &valueExp{value: v}
+}
+
+// NewReference returns a ReferenceNode to variable. It is meant to be
+// used with Rewrite.
+func NewReference(variable string) Expression {
+	return &refExp{variable: variable}
+}
+
+// children returns the direct children of e
+func children(e Expression) []Expression {
+	switch n := e.(type) {
+	case OperatorNode:
+		return n.Operands()
+	case CallNode:
+		return n.Arguments()
+	case *cachedExp:
+		return []Expression{n.expr}
+	}
+	return nil
+}
+
+// withChildren returns a copy of e with the given children. e should
+// be an OperatorNode, a CallNode or a variable of a CachedContext,
+// and children the same length than its own.
+func withChildren(e Expression, children []Expression) Expression {
+	switch n := e.(type) {
+	case *unaryExp:
+		res := *n
+		res.child = children[0]
+		return &res
+	case *binaryExp:
+		res := *n
+		res.leftChild, res.rightChild = children[0], children[1]
+		return &res
+	case *lazyBinaryExp:
+		res := *n
+		res.leftChild, res.rightChild = children[0], children[1]
+		return &res
+	case *nExp:
+		res := *n
+		res.children = children
+		return &res
+	case *lazyExp:
+		res := *n
+		res.children = children
+		return &res
+	case *cachedExp:
+		// the copy is still evaluated within the CachedContext, but
+		// it is never memoized, as it would not be invalidated
+		return &cachedExp{ctx: n.ctx, expr: children[0], deps: Dependencies(children[0])}
+	}
+	return e
+}
+
+// A Visitor's Visit method is invoked for each Expression encountered
+// by Walk. If the result visitor w is not nil, Walk visits each of
+// the children of the Expression with the visitor w, followed by a
+// call of w.Visit(nil).
+type Visitor interface {
+	Visit(e Expression) (w Visitor)
+}
+
+// Walk traverses an AST in depth-first order: It starts by calling
+// v.Visit(e); e must not be nil. If the visitor w returned by
+// v.Visit(e) is not nil, Walk is invoked recursively with visitor w
+// for each of the non-nil children of e, followed by a call of
+// w.Visit(nil).
+func Walk(v Visitor, e Expression) {
+	if v = v.Visit(e); v == nil {
+		return
+	}
+	for _, c := range children(e) {
+		if c != nil {
+			Walk(v, c)
+		}
+	}
+	v.Visit(nil)
+}
+
+type inspector func(Expression) bool
+
+func (f inspector) Visit(e Expression) Visitor {
+	if f(e) == true {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses an AST in depth-first order: It starts by calling
+// f(e); e must not be nil. If f returns true, Inspect invokes f
+// recursively for each of the non-nil children of e, followed by a
+// call of f(nil).
+func Inspect(e Expression, f func(Expression) bool) {
+	Walk(inspector(f), e)
+}
+
+// Rewrite returns a copy of the AST e, where every Expression is
+// replaced by the result of f. The AST is traversed in depth-first
+// order, so f receives Expression whose children are already
+// rewritten. e is left untouched.
+func Rewrite(e Expression, f func(Expression) Expression) Expression {
+	if cs := children(e); len(cs) > 0 {
+		for i, c := range cs {
+			cs[i] = Rewrite(c, f)
+		}
+		e = withChildren(e, cs)
+	}
+	return f(e)
+}
@@ -0,0 +1,118 @@
+package meval
+
+import (
+	"fmt"
+
+	. "gopkg.in/check.v1"
+)
+
+type AstSuite struct{}
+
+var _ = Suite(&AstSuite{})
+
+// describe returns a prefix notation of e
+func describe(e Expression) string {
+	switch n := e.(type) {
+	case ValueNode:
+		return fmt.Sprintf("%g", n.Value())
+	case ReferenceNode:
+		return "$" + n.Variable()
+	case OperatorNode:
+		res := "(" + n.Operator()
+		for _, o := range n.Operands() {
+			res += " " + describe(o)
+		}
+		return res + ")"
+	case CallNode:
+		res := "(" + n.Function() + "()"
+		for _, a := range n.Arguments() {
+			res += " " + describe(a)
+		}
+		return res + ")"
+	}
+	return "?"
+}
+
+func (s *AstSuite) TestNodesExposeTheirStructure(c *C) {
+	tests := []struct {
+		input, ast string
+	}{
+		{"1 + 2 * foo", "(+ 1 (* 2 $foo))"},
+		{"-foo^2", "(- (^ $foo 2))"},
+		{"2 - 3", "(- 2 3)"},
+		{"atan2(1, -x)", "(atan2() 1 (- $x))"},
+		{"pi()", "(pi())"},
+		{"a > 0 && !b", "(&& (> $a 0) (! $b))"},
+		{"if(a, b, max(c, d, 4))", "(if() $a $b (max() $c $d 4))"},
+	}
+
+	for _, t := range tests {
+		e, err := Compile(t.input)
+		c.Assert(err, IsNil)
+		c.Check(describe(e), Equals, t.ast, Commentf("input: %s", t.input))
+	}
+}
+
+type countingVisitor struct {
+	nodes, ends int
+}
+
+func (v *countingVisitor) Visit(e Expression) Visitor {
+	if e == nil {
+		v.ends++
+	} else {
+		v.nodes++
+	}
+	return v
+}
+
+func (s *AstSuite) TestWalkAndInspect(c *C) {
+	e, err := Compile("sin(a) + b * max(1, c, 2)")
+	c.Assert(err, IsNil)
+
+	v := &countingVisitor{}
+	Walk(v, e)
+	c.Check(v.nodes, Equals, 9)
+	// each visit is closed by a Visit(nil)
+	c.Check(v.ends, Equals, 9)
+
+	var refs []string
+	Inspect(e, func(e Expression) bool {
+		if ref, ok := e.(ReferenceNode); ok == true {
+			refs = append(refs, ref.Variable())
+		}
+		// do not look into function calls
+		_, isCall := e.(CallNode)
+		return isCall == false
+	})
+	c.Check(refs, DeepEquals, []string{"b"})
+}
+
+func (s *AstSuite) TestRewrite(c *C) {
+	e, err := Compile("a * (b + a)")
+	c.Assert(err, IsNil)
+
+	rewritten := Rewrite(e, func(e Expression) Expression {
+		if ref, ok := e.(ReferenceNode); ok == true && ref.Variable() == "a" {
+			return NewValue(2)
+		}
+		return e
+	})
+	c.Check(describe(rewritten), Equals, "(* 2 (+ $b 2))")
+	// original is left untouched
+	c.Check(describe(e), Equals, "(* $a (+ $b $a))")
+
+	ctx := NewMapContext()
+	ctx.Add("b", NewValue(3))
+	res, err := rewritten.Eval(ctx)
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, 10.0)
+
+	renamed := Rewrite(e, func(e Expression) Expression {
+		if ref, ok := e.(ReferenceNode); ok == true {
+			return NewReference(ref.Variable() + "_renamed")
+		}
+		return e
+	})
+	c.Check(describe(renamed), Equals, "(* $a_renamed (+ $b_renamed $a_renamed))")
+}
@@ -0,0 +1,478 @@
+package meval
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// EvalBatch evaluates e for each row of columns, and stores the
+// results in out. Each column holds the values of a variable, and
+// must have one value per row of out. See EvalBatchWithContext.
+func EvalBatch(e Expression, columns map[string][]float64, out []float64) error {
+	return EvalBatchWithContext(e, nil, columns, out)
+}
+
+// EvalBatchWithContext evaluates e for each row of columns, and stores
+// the results in out. Variables that are not columns are looked up in
+// c, that can be nil, so it holds the parameters that are constant
+// across the batch.
+//
+// Each node of e is evaluated once over all the rows, instead of once
+// per row. The nodes that do not depend on any column, like the
+// parameters of c, are only evaluated once, and each variable of c is
+// evaluated at most once per batch, unless it calls an Impure
+// function. Variables of a CachedContext that do not depend on any
+// column are evaluated by the CachedContext, so their memoized value
+// is used. Impure functions, like
+// rand(), are called once per row, and user lazy functions are
+// evaluated row by row with Expression.Eval. Like Eval, the branches
+// of if(), && and || are only evaluated for the rows that take them.
+//
+// Errors that happen on a single row are reported as a *RowError.
+func EvalBatchWithContext(e Expression, c Context, columns map[string][]float64, out []float64) error {
+	names := make([]string, 0, len(columns))
+	for name := range columns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if len(columns[name]) != len(out) {
+			return fmt.Errorf("Column '%s' has %d rows, expected %d", name, len(columns[name]), len(out))
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+
+	b := &batch{
+		size:      len(out),
+		columns:   columns,
+		variables: make(map[variableKey]vector),
+	}
+	res, err := b.eval(e, c, nil)
+	if err != nil {
+		return err
+	}
+	if res.values == nil {
+		for i := range out {
+			out[i] = res.scalar
+		}
+		return nil
+	}
+	copy(out, res.values)
+	return nil
+}
+
+// vector is the value of a node for all the rows of a batch
+type vector struct {
+	// one value per row, nil if all rows have the same value
+	values []float64
+	scalar float64
+	// true if values is a buffer of the batch, that can be reused
+	owned bool
+}
+
+func (v vector) at(row int) float64 {
+	if v.values == nil {
+		return v.scalar
+	}
+	return v.values[row]
+}
+
+// batch is the state of a batch evaluation. A mask selects the rows
+// to evaluate, a nil mask selects all of them. The values of the rows
+// that are not selected are unspecified.
+type batch struct {
+	size    int
+	columns map[string][]float64
+	// released buffers, reused by later nodes
+	free [][]float64
+	// references being evaluated, to detect cycles
+	stack CallStack
+	// values of the variables evaluated for all rows. They are not
+	// owned, so never reused as buffers.
+	variables map[variableKey]vector
+	// true if the node being evaluated calls an Impure function
+	impure bool
+}
+
+func active(mask []bool, row int) bool {
+	return mask == nil || mask[row] == true
+}
+
+func anyActive(mask []bool) bool {
+	if mask == nil {
+		return true
+	}
+	for _, m := range mask {
+		if m == true {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *batch) buffer() []float64 {
+	if len(b.free) == 0 {
+		return make([]float64, b.size)
+	}
+	res := b.free[len(b.free)-1]
+	b.free = b.free[:len(b.free)-1]
+	return res
+}
+
+// output returns the vector holding the result of an element-wise
+// operation on args, reusing one of their buffers if possible.
+func (b *batch) output(args []vector) vector {
+	for i := range args {
+		if args[i].owned == true {
+			res := args[i]
+			args[i].owned = false
+			return res
+		}
+	}
+	return vector{values: b.buffer(), owned: true}
+}
+
+// release makes the buffers of args available for later nodes
+func (b *batch) release(args []vector) {
+	for _, a := range args {
+		if a.owned == true {
+			b.free = append(b.free, a.values)
+		}
+	}
+}
+
+func (b *batch) evalAll(exprs []Expression, c Context, mask []bool) ([]vector, bool, error) {
+	args := make([]vector, len(exprs))
+	scalar := true
+	for i, e := range exprs {
+		var err error
+		if args[i], err = b.eval(e, c, mask); err != nil {
+			b.release(args[:i])
+			return nil, false, err
+		}
+		scalar = scalar && args[i].values == nil
+	}
+	return args, scalar, nil
+}
+
+func (b *batch) eval(e Expression, c Context, mask []bool) (vector, error) {
+	switch n := e.(type) {
+	case *valueExp:
+		return vector{scalar: n.value}, nil
+	case *refExp:
+		return b.evalRef(n, c, mask)
+	case *cachedExp:
+		return b.evalCached(n, mask)
+	case *unaryExp:
+		return b.evalCall([]Expression{n.child}, c, mask, n.impure, func(a []float64) (float64, error) {
+			return n.evaluer(a[0])
+		})
+	case *binaryExp:
+		if op := arithmetic(n); op != nil {
+			return b.evalArithmetic(n, op, c, mask)
+		}
+		return b.evalCall([]Expression{n.leftChild, n.rightChild}, c, mask, n.impure, func(a []float64) (float64, error) {
+			return n.evaluer(a[0], a[1])
+		})
+	case *nExp:
+		return b.evalCall(n.children, c, mask, n.impure, n.evaluer)
+	case *lazyExp:
+		if n.builtin == true && n.name == "if" {
+			return b.evalIf(n, c, mask)
+		}
+	case *lazyBinaryExp:
+		if n.builtin == true && (n.name == "&&" || n.name == "||") {
+			return b.evalLogical(n, c, mask)
+		}
+	}
+	return b.evalRows(e, c, mask)
+}
+
+func (b *batch) evalRef(e *refExp, c Context, mask []bool) (vector, error) {
+	if col, ok := b.columns[e.variable]; ok == true {
+		return vector{values: col}, nil
+	}
+	if anyActive(mask) == false {
+		return vector{scalar: math.NaN()}, nil
+	}
+	if c == nil {
+		return vector{}, &NoContextError{Name: e.variable}
+	}
+	if bad, deps := b.stack.testStack(e); bad == true {
+		deps = append([]string{deps[len(deps)-1]},
+			deps...)
+		return vector{}, &CyclicDependencyError{Cycle: deps}
+	}
+	key := keyOf(c, e.variable)
+	if res, ok := b.variables[key]; ok == true {
+		return res, nil
+	}
+	b.stack.push(e)
+	defer b.stack.pop()
+	expr, err := c.GetExpression(e.variable)
+	if err != nil {
+		return vector{}, err
+	}
+	impure := b.impure
+	b.impure = false
+	res, err := b.eval(expr, c, mask)
+	// values of impure definitions differ at each reference
+	if err == nil && mask == nil && b.impure == false && key.ctx != nil {
+		res.owned = false
+		b.variables[key] = res
+	}
+	b.impure = impure || b.impure
+	if err != nil {
+		if rerr, ok := err.(*RowError); ok == true {
+			return vector{}, &RowError{Row: rerr.Row, Err: wrapEvalError(e.variable, rerr.Err)}
+		}
+		return vector{}, wrapEvalError(e.variable, err)
+	}
+	return res, nil
+}
+
+// evalCached evaluates a variable of a CachedContext. If it does not
+// depend on any column, its memoized value is used.
+func (b *batch) evalCached(e *cachedExp, mask []bool) (vector, error) {
+	for _, d := range TransitiveDependencies(e.expr, e.ctx) {
+		if _, ok := b.columns[d]; ok == true {
+			return b.eval(e.expr, e.ctx, mask)
+		}
+	}
+	if IsDeterministic(e.expr, e.ctx) == false {
+		return b.eval(e.expr, e.ctx, mask)
+	}
+	if anyActive(mask) == false {
+		return vector{scalar: math.NaN()}, nil
+	}
+	v, err := e.Eval(nil)
+	return vector{scalar: v}, err
+}
+
+// evalCall evaluates an operator or a function. Unless it is impure,
+// it is only evaluated once if all its arguments are the same for
+// all rows.
+func (b *batch) evalCall(exprs []Expression, c Context, mask []bool, impure bool, evaluer FallibleEvaluer) (vector, error) {
+	b.impure = b.impure || impure
+	args, scalar, err := b.evalAll(exprs, c, mask)
+	if err != nil {
+		return vector{}, err
+	}
+	values := make([]float64, len(args))
+	if scalar == true && impure == false {
+		if anyActive(mask) == false {
+			return vector{scalar: math.NaN()}, nil
+		}
+		for i, a := range args {
+			values[i] = a.scalar
+		}
+		v, err := evaluer(values)
+		return vector{scalar: v}, err
+	}
+
+	res := b.output(args)
+	defer b.release(args)
+	for row := 0; row < b.size; row++ {
+		if active(mask, row) == false {
+			continue
+		}
+		for i, a := range args {
+			values[i] = a.at(row)
+		}
+		v, err := evaluer(values)
+		if err != nil {
+			b.release([]vector{res})
+			return vector{}, &RowError{Row: row, Err: err}
+		}
+		res.values[row] = v
+	}
+	return res, nil
+}
+
+// arithmetic returns the operation of the built-in arithmetic
+// operators, that cannot fail, or nil.
+func arithmetic(e *binaryExp) func(a, b float64) float64 {
+	if e.builtin == false {
+		return nil
+	}
+	switch e.name {
+	case "+":
+		return func(a, b float64) float64 { return a + b }
+	case "-":
+		return func(a, b float64) float64 { return a - b }
+	case "*":
+		return func(a, b float64) float64 { return a * b }
+	case "/":
+		return func(a, b float64) float64 { return a / b }
+	}
+	return nil
+}
+
+// evalArithmetic evaluates a built-in arithmetic operator, that is
+// computed for all rows as it cannot fail.
+func (b *batch) evalArithmetic(e *binaryExp, op func(a, b float64) float64, c Context, mask []bool) (vector, error) {
+	args, scalar, err := b.evalAll([]Expression{e.leftChild, e.rightChild}, c, mask)
+	if err != nil {
+		return vector{}, err
+	}
+	if scalar == true {
+		return vector{scalar: op(args[0].scalar, args[1].scalar)}, nil
+	}
+	left, right := args[0], args[1]
+	res := b.output(args)
+	for row := range res.values {
+		res.values[row] = op(left.at(row), right.at(row))
+	}
+	b.release(args)
+	return res, nil
+}
+
+func (b *batch) evalIf(e *lazyExp, c Context, mask []bool) (vector, error) {
+	cond, err := b.eval(e.children[0], c, mask)
+	if err != nil {
+		return vector{}, err
+	}
+	if cond.values == nil {
+		if cond.scalar != 0 {
+			return b.eval(e.children[1], c, mask)
+		}
+		return b.eval(e.children[2], c, mask)
+	}
+
+	thenMask, elseMask := make([]bool, b.size), make([]bool, b.size)
+	for row, v := range cond.values {
+		if active(mask, row) == true {
+			thenMask[row] = v != 0
+			elseMask[row] = v == 0
+		}
+	}
+	b.release([]vector{cond})
+	then, err := b.eval(e.children[1], c, thenMask)
+	if err != nil {
+		return vector{}, err
+	}
+	otherwise, err := b.eval(e.children[2], c, elseMask)
+	if err != nil {
+		b.release([]vector{then})
+		return vector{}, err
+	}
+	args := []vector{then, otherwise}
+	res := b.output(args)
+	for row := range res.values {
+		if thenMask[row] == true {
+			res.values[row] = then.at(row)
+		} else if elseMask[row] == true {
+			res.values[row] = otherwise.at(row)
+		}
+	}
+	b.release(args)
+	return res, nil
+}
+
+func (b *batch) evalLogical(e *lazyBinaryExp, c Context, mask []bool) (vector, error) {
+	// false for '&&', or true for '||', short-circuits
+	and := e.name == "&&"
+	left, err := b.eval(e.leftChild, c, mask)
+	if err != nil {
+		return vector{}, err
+	}
+	if left.values == nil {
+		if (left.scalar != 0) != and {
+			return vector{scalar: boolToFloat(!and)}, nil
+		}
+		right, err := b.eval(e.rightChild, c, mask)
+		if err != nil {
+			return vector{}, err
+		}
+		return b.truth(right), nil
+	}
+
+	rightMask := make([]bool, b.size)
+	for row, v := range left.values {
+		rightMask[row] = active(mask, row) == true && (v != 0) == and
+	}
+	right, err := b.eval(e.rightChild, c, rightMask)
+	if err != nil {
+		b.release([]vector{left})
+		return vector{}, err
+	}
+	args := []vector{left, right}
+	res := b.output(args)
+	for row := range res.values {
+		if rightMask[row] == true {
+			res.values[row] = boolToFloat(right.at(row) != 0)
+		} else {
+			res.values[row] = boolToFloat(!and)
+		}
+	}
+	b.release(args)
+	return res, nil
+}
+
+// truth converts v to 1.0 if true, 0.0 otherwise
+func (b *batch) truth(v vector) vector {
+	if v.values == nil {
+		return vector{scalar: boolToFloat(v.scalar != 0)}
+	}
+	args := []vector{v}
+	res := b.output(args)
+	for row, x := range v.values {
+		res.values[row] = boolToFloat(x != 0)
+	}
+	b.release(args)
+	return res
+}
+
+// evalRows evaluates e row by row with Expression.Eval, or only once
+// if it does not depend on the columns.
+func (b *batch) evalRows(e Expression, c Context, mask []bool) (vector, error) {
+	if anyActive(mask) == false {
+		return vector{scalar: math.NaN()}, nil
+	}
+	deterministic := IsDeterministic(e, c)
+	b.impure = b.impure || deterministic == false
+	constant := deterministic
+	for _, d := range TransitiveDependencies(e, c) {
+		if _, ok := b.columns[d]; ok == true {
+			constant = false
+		}
+	}
+	if constant == true {
+		v, err := e.Eval(c)
+		return vector{scalar: v}, err
+	}
+
+	res := vector{values: b.buffer(), owned: true}
+	for row := range res.values {
+		if active(mask, row) == false {
+			continue
+		}
+		v, err := e.Eval(&rowContext{b: b, row: row, ctx: c})
+		if err != nil {
+			b.release([]vector{res})
+			return vector{}, &RowError{Row: row, Err: err}
+		}
+		res.values[row] = v
+	}
+	return res, nil
+}
+
+// rowContext is the Context of the evaluation of a single row
+type rowContext struct {
+	b   *batch
+	row int
+	ctx Context
+}
+
+func (c *rowContext) GetExpression(name string) (Expression, error) {
+	if col, ok := c.b.columns[name]; ok == true {
+		return &valueExp{value: col[c.row]}, nil
+	}
+	if c.ctx == nil {
+		return nil, &NoContextError{Name: name}
+	}
+	return c.ctx.GetExpression(name)
+}
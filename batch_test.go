@@ -0,0 +1,270 @@
+package meval
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	. "gopkg.in/check.v1"
+)
+
+type BatchSuite struct {
+	columns map[string][]float64
+	rows    int
+}
+
+var _ = Suite(&BatchSuite{})
+
+func (s *BatchSuite) SetUpTest(c *C) {
+	s.rows = 50
+	s.columns = map[string][]float64{
+		"x": make([]float64, s.rows),
+		"y": make([]float64, s.rows),
+	}
+	for i := 0; i < s.rows; i++ {
+		s.columns["x"][i] = float64(i)/10 - 2
+		s.columns["y"][i] = math.Sin(float64(i))
+	}
+}
+
+// rowContext returns a Context holding the values of a row
+func (s *BatchSuite) rowContext(row int, params Context) *ScopeContext {
+	ctx := NewScopeContext(params)
+	for name, col := range s.columns {
+		ctx.Set(name, col[row])
+	}
+	return ctx
+}
+
+func (s *BatchSuite) TestMatchesEval(c *C) {
+	c.Assert(RegisterLazyFunction("first", 2, func(args []Expression, ctx Context) (float64, error) {
+		return args[0].Eval(ctx)
+	}), IsNil)
+	defer UnregisterFunction("first")
+
+	params := NewMapContext()
+	c.Assert(params.CompileAndAdd("gain", "2 * offset"), IsNil)
+	c.Assert(params.CompileAndAdd("offset", "0.5"), IsNil)
+	c.Assert(params.CompileAndAdd("scaled", "gain * x"), IsNil)
+
+	inputs := []string{
+		"3",
+		"gain + offset",
+		"x * y + 2 * x - y / 3",
+		"-x ^ 2 + +y - !(x > y)",
+		"sqrt(x) + ln(y)",
+		"if(x > 0, sin(x), cos(y))",
+		"if(gain > 0, x, y)",
+		"x > 0 && y < 0 || x == 0",
+		"(x > 1) || (y > 0.5)",
+		"gain && y",
+		"max(x, y, gain) + sum(x, 1) + atan2(y, x)",
+		"scaled + first(x * gain, y)",
+		"first(gain, 0) * x",
+	}
+	out := make([]float64, s.rows)
+	for _, input := range inputs {
+		e, err := Compile(input)
+		c.Assert(err, IsNil)
+		c.Assert(EvalBatchWithContext(e, params, s.columns, out), IsNil, Commentf("input: %s", input))
+		for row := 0; row < s.rows; row++ {
+			expected, err := e.Eval(s.rowContext(row, params))
+			c.Assert(err, IsNil)
+			if math.IsNaN(expected) == true {
+				c.Check(math.IsNaN(out[row]), Equals, true, Commentf("input: %s, row %d", input, row))
+				continue
+			}
+			c.Check(out[row], Equals, expected, Commentf("input: %s, row %d", input, row))
+		}
+	}
+}
+
+func (s *BatchSuite) TestImpureFunctionsAreCalledPerRow(c *C) {
+	calls := 0
+	c.Assert(RegisterFunction("counter", 0, func([]float64) float64 {
+		calls++
+		return float64(calls)
+	}, Impure), IsNil)
+	defer UnregisterFunction("counter")
+	pureCalls := 0
+	c.Assert(RegisterFunction("constant", 0, func([]float64) float64 {
+		pureCalls++
+		return 1
+	}), IsNil)
+	defer UnregisterFunction("constant")
+
+	e, err := Compile("counter() + constant()")
+	c.Assert(err, IsNil)
+	out := make([]float64, s.rows)
+	c.Assert(EvalBatch(e, s.columns, out), IsNil)
+	c.Check(calls, Equals, s.rows)
+	c.Check(pureCalls, Equals, 1)
+	for row, v := range out {
+		c.Check(v, Equals, float64(row+2))
+	}
+
+	// only the rows taking a branch evaluate it
+	calls = 0
+	e, err = Compile("if(x > 0, counter(), 0)")
+	c.Assert(err, IsNil)
+	c.Assert(EvalBatch(e, s.columns, out), IsNil)
+	c.Check(calls, Equals, 29)
+}
+
+func (s *BatchSuite) TestErrors(c *C) {
+	c.Assert(RegisterFallibleFunction("positive", 1, func(a []float64) (float64, error) {
+		if a[0] <= 0 {
+			return math.NaN(), fmt.Errorf("%g is not positive", a[0])
+		}
+		return a[0], nil
+	}), IsNil)
+	defer UnregisterFunction("positive")
+
+	params := NewMapContext()
+	c.Assert(params.CompileAndAdd("checked", "positive(x)"), IsNil)
+	c.Assert(params.CompileAndAdd("loop", "loop * 2"), IsNil)
+
+	out := make([]float64, s.rows)
+	tests := []struct {
+		input, error string
+	}{
+		{"if(x > 0, positive(x), 0) + (x > 0 && positive(x))", ""},
+		{"if(x < -5, missing, loop * 0 + x)", "in loop -> loop: Got cyclic dependency loop -> loop"},
+		{"positive(x) + y", "row 0: Error in 'positive\\(\\)': -2 is not positive"},
+		{"checked", "row 0: in checked: Error in 'positive\\(\\)': -2 is not positive"},
+		{"missing + x", "Could not find 'missing' in MapContext"},
+	}
+	for _, t := range tests {
+		e, err := Compile(t.input)
+		c.Assert(err, IsNil)
+		err = EvalBatchWithContext(e, params, s.columns, out)
+		if len(t.error) == 0 {
+			c.Check(err, IsNil, Commentf("input: %s", t.input))
+			continue
+		}
+		c.Check(err, ErrorMatches, t.error, Commentf("input: %s", t.input))
+	}
+
+	e, err := Compile("positive(x)")
+	c.Assert(err, IsNil)
+	err = EvalBatch(e, s.columns, out)
+	var rerr *RowError
+	c.Assert(errors.As(err, &rerr), Equals, true)
+	c.Check(rerr.Row, Equals, 0)
+	var ferr *FunctionError
+	c.Check(errors.As(err, &ferr), Equals, true)
+
+	e, err = Compile("x + z")
+	c.Assert(err, IsNil)
+	c.Check(EvalBatch(e, s.columns, out), ErrorMatches, "'z' referenced, but no Context providen")
+	c.Check(EvalBatch(e, s.columns, out[:10]), ErrorMatches, "Column 'x' has 50 rows, expected 10")
+	c.Check(EvalBatch(e, nil, nil), IsNil)
+}
+
+func (s *BatchSuite) BenchmarkEvalPerRow(c *C) {
+	e, err := Compile(controlLaw)
+	c.Assert(err, IsNil)
+	ctx := NewMapContext()
+	for name, v := range map[string]float64{"kp": 0.8, "ki": 0.1, "limit": 2, "integral": 0.5, "abs": 2} {
+		ctx.Add(name, NewValue(v))
+	}
+	rows := 10000
+	errs, ts := make([]float64, rows), make([]float64, rows)
+	for i := range errs {
+		errs[i], ts[i] = math.Sin(float64(i)), float64(i)/1000
+	}
+	scope := NewScopeContext(ctx)
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		for row := 0; row < rows; row++ {
+			scope.Set("err", errs[row])
+			scope.Set("t", ts[row])
+			e.Eval(scope)
+		}
+	}
+}
+
+func (s *BatchSuite) BenchmarkEvalBatch(c *C) {
+	e, err := Compile(controlLaw)
+	c.Assert(err, IsNil)
+	ctx := NewMapContext()
+	for name, v := range map[string]float64{"kp": 0.8, "ki": 0.1, "limit": 2, "integral": 0.5, "abs": 2} {
+		ctx.Add(name, NewValue(v))
+	}
+	rows := 10000
+	columns := map[string][]float64{"err": make([]float64, rows), "t": make([]float64, rows)}
+	for i := 0; i < rows; i++ {
+		columns["err"][i], columns["t"][i] = math.Sin(float64(i)), float64(i)/1000
+	}
+	out := make([]float64, rows)
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		EvalBatchWithContext(e, ctx, columns, out)
+	}
+}
+
+func (s *BatchSuite) TestSharedVariablesAreEvaluatedOnce(c *C) {
+	calls := 0
+	c.Assert(RegisterFunction("counted", 1, func(a []float64) float64 {
+		calls++
+		return a[0]
+	}), IsNil)
+	defer UnregisterFunction("counted")
+
+	// each level references the previous one twice
+	chain := func(ctx interface {
+		CompileAndAdd(string, string) error
+	}, first string) {
+		c.Assert(ctx.CompileAndAdd("x0", first), IsNil)
+		for i := 1; i <= 22; i++ {
+			c.Assert(ctx.CompileAndAdd(fmt.Sprintf("x%d", i), fmt.Sprintf("x%d + x%d", i-1, i-1)), IsNil)
+		}
+	}
+	e, err := Compile("x22 + x21")
+	c.Assert(err, IsNil)
+	out := make([]float64, s.rows)
+
+	ctx := NewMapContext()
+	chain(ctx, "counted(x)")
+	c.Assert(EvalBatchWithContext(e, ctx, s.columns, out), IsNil)
+	c.Check(calls, Equals, s.rows)
+	for row, x := range s.columns["x"] {
+		c.Check(out[row], Equals, x*(1<<22+1<<21))
+	}
+
+	// the memoized values of a CachedContext are used
+	calls = 0
+	cached := NewCachedContext()
+	chain(cached, "counted(3)")
+	for i := 0; i < 2; i++ {
+		c.Assert(EvalBatchWithContext(e, cached, s.columns, out), IsNil)
+		c.Check(out[0], Equals, 3.0*(1<<22+1<<21))
+	}
+	c.Check(calls, Equals, 1)
+
+	calls = 0
+	cached = NewCachedContext()
+	chain(cached, "counted(x)")
+	c.Assert(EvalBatchWithContext(e, cached, s.columns, out), IsNil)
+	c.Check(calls, Equals, s.rows)
+	c.Check(out[s.rows-1], Equals, s.columns["x"][s.rows-1]*(1<<22+1<<21))
+
+	// impure variables are evaluated at each reference
+	ctx = NewMapContext()
+	c.Assert(ctx.CompileAndAdd("noise", "rand() + x"), IsNil)
+	e, err = Compile("noise - noise")
+	c.Assert(err, IsNil)
+	c.Assert(EvalBatchWithContext(e, ctx, s.columns, out), IsNil)
+	c.Check(out[0], Not(Equals), 0.0)
+}
+
+func (s *BatchSuite) TestValueContext(c *C) {
+	ctx := newValueContext(c, map[string]string{"a": "2 * x", "b": "a + a"})
+	e, err := Compile("b + a")
+	c.Assert(err, IsNil)
+	out := make([]float64, s.rows)
+	c.Assert(EvalBatchWithContext(e, ctx, s.columns, out), IsNil)
+	for row, v := range out {
+		c.Check(v, Equals, 6*s.columns["x"][row])
+	}
+}
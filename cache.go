@@ -0,0 +1,191 @@
+package meval
+
+import (
+	"math"
+	"sync"
+)
+
+// CachedContext is a Context that memoizes the values of its
+// variables. When a variable is modified with Add or Delete, only the
+// variables that depends on it, directly or not, are evaluated again.
+//
+// Variables are evaluated within the CachedContext itself, so a value
+// never depends on the Context it is referenced from, like the local
+// variables of a ScopeContext. Variables depending on an Impure
+// function, like rand(), or on an undefined variable are never
+// memoized.
+//
+// A CachedContext is safe for concurrent use.
+type CachedContext struct {
+	mx    sync.Mutex
+	exprs map[string]*cachedExp
+	// variables directly depending on each variable, defined or not
+	dependents map[string]map[string]bool
+	// incremented on each modification, so values evaluated before
+	// are not memoized
+	generation uint64
+}
+
+// cachedExp is the Expression returned by CachedContext.GetExpression
+type cachedExp struct {
+	ctx  *CachedContext
+	expr Expression
+	deps []string
+	pure bool
+
+	// memoized value, protected by ctx.mx
+	valid bool
+	value float64
+}
+
+// NewCachedContext creates an empty CachedContext
+func NewCachedContext() *CachedContext {
+	return &CachedContext{
+		exprs:      make(map[string]*cachedExp),
+		dependents: make(map[string]map[string]bool),
+	}
+}
+
+// GetExpression returns the Expression stored in the
+// CachedContext. Its evaluation is memoized.
+func (c *CachedContext) GetExpression(name string) (Expression, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if e, ok := c.exprs[name]; ok == true {
+		return e, nil
+	}
+	return nil, &UndefinedVariableError{Name: name, Context: "CachedContext"}
+}
+
+// Add adds or replaces an expression, invalidating the memoized
+// values of all the variables that depends on it.
+func (c *CachedContext) Add(name string, e Expression) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.remove(name)
+	ce := &cachedExp{
+		ctx:  c,
+		expr: e,
+		deps: Dependencies(e),
+		pure: isPure(e),
+	}
+	for _, d := range ce.deps {
+		if c.dependents[d] == nil {
+			c.dependents[d] = make(map[string]bool)
+		}
+		c.dependents[d][name] = true
+	}
+	c.exprs[name] = ce
+}
+
+// CompileAndAdd compiles and adds a new expression to the
+// CachedContext. It returns the same errors than Compile().
+func (c *CachedContext) CompileAndAdd(name, input string) error {
+	e, err := Compile(input)
+	if err != nil {
+		return err
+	}
+	c.Add(name, e)
+	return nil
+}
+
+// Delete deletes the given expression from the CachedContext if it
+// exists, invalidating the memoized values of all the variables that
+// depends on it.
+func (c *CachedContext) Delete(name string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.remove(name)
+}
+
+// remove removes the definition of name, and invalidates all the
+// values depending on it. c.mx should be held.
+func (c *CachedContext) remove(name string) {
+	c.generation++
+	c.invalidate(name)
+	e, ok := c.exprs[name]
+	if ok == false {
+		return
+	}
+	for _, d := range e.deps {
+		delete(c.dependents[d], name)
+		if len(c.dependents[d]) == 0 {
+			delete(c.dependents, d)
+		}
+	}
+	delete(c.exprs, name)
+}
+
+// invalidate forgets the value of name and of all the variables
+// depending on it. c.mx should be held.
+func (c *CachedContext) invalidate(name string) {
+	toVisit := []string{name}
+	visited := make(map[string]bool)
+	for len(toVisit) > 0 {
+		name := toVisit[len(toVisit)-1]
+		toVisit = toVisit[:len(toVisit)-1]
+		if visited[name] == true {
+			continue
+		}
+		visited[name] = true
+		if e, ok := c.exprs[name]; ok == true {
+			e.valid = false
+		}
+		for d := range c.dependents[name] {
+			toVisit = append(toVisit, d)
+		}
+	}
+}
+
+// memoizable returns true if the value of e only depends on pure
+// expressions defined in c. c.mx should be held.
+func (c *CachedContext) memoizable(e *cachedExp) bool {
+	visited := make(map[*cachedExp]bool)
+	var visit func(e *cachedExp) bool
+	visit = func(e *cachedExp) bool {
+		if e.valid == true || visited[e] == true {
+			return true
+		}
+		visited[e] = true
+		if e.pure == false {
+			return false
+		}
+		for _, d := range e.deps {
+			dep, ok := c.exprs[d]
+			if ok == false || visit(dep) == false {
+				return false
+			}
+		}
+		return true
+	}
+	return visit(e)
+}
+
+func (e *cachedExp) Eval(c Context) (float64, error) {
+	ctx := e.ctx
+	ctx.mx.Lock()
+	if e.valid == true {
+		ctx.mx.Unlock()
+		return e.value, nil
+	}
+	generation := ctx.generation
+	ctx.mx.Unlock()
+
+	// the call stack of the evaluation is kept to detect cycles
+	res, err := e.expr.Eval(&evalFrame{Context: ctx, stack: frameOf(c).stack})
+	if err != nil {
+		return math.NaN(), err
+	}
+
+	ctx.mx.Lock()
+	defer ctx.mx.Unlock()
+	if ctx.generation == generation && ctx.memoizable(e) == true {
+		e.valid = true
+		e.value = res
+	}
+	return res, nil
+}
+
+func (e *cachedExp) String() string {
+	return format(e.expr)
+}
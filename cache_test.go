@@ -0,0 +1,176 @@
+package meval
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	. "gopkg.in/check.v1"
+)
+
+type CacheSuite struct {
+	// number of calls to count()
+	calls map[float64]int
+	mx    sync.Mutex
+}
+
+var _ = Suite(&CacheSuite{})
+
+func (s *CacheSuite) SetUpTest(c *C) {
+	s.calls = make(map[float64]int)
+	c.Assert(RegisterFunction("count", 2, func(a []float64) float64 {
+		s.mx.Lock()
+		defer s.mx.Unlock()
+		s.calls[a[0]]++
+		return a[1]
+	}), IsNil)
+}
+
+func (s *CacheSuite) TearDownTest(c *C) {
+	UnregisterFunction("count")
+}
+
+func (s *CacheSuite) eval(c *C, ctx Context, input string) float64 {
+	e, err := Compile(input)
+	c.Assert(err, IsNil)
+	res, err := e.Eval(ctx)
+	c.Assert(err, IsNil)
+	return res
+}
+
+func (s *CacheSuite) TestMemoizesSharedVariables(c *C) {
+	ctx := NewCachedContext()
+	c.Assert(ctx.CompileAndAdd("x0", "count(0, 1)"), IsNil)
+	for i := 1; i <= 30; i++ {
+		c.Assert(ctx.CompileAndAdd(fmt.Sprintf("x%d", i),
+			fmt.Sprintf("count(%d, x%d + x%d)", i, i-1, i-1)), IsNil)
+	}
+	c.Assert(ctx.CompileAndAdd("other", "count(100, 3)"), IsNil)
+
+	c.Check(s.eval(c, ctx, "x30 + other"), Equals, math.Pow(2, 30)+3)
+	c.Check(s.eval(c, ctx, "x30 + other"), Equals, math.Pow(2, 30)+3)
+	for i := 0; i <= 30; i++ {
+		c.Check(s.calls[float64(i)], Equals, 1, Commentf("x%d", i))
+	}
+	c.Check(s.calls[100], Equals, 1)
+
+	// only the dependent variables are evaluated again
+	c.Assert(ctx.CompileAndAdd("x20", "count(20, 2)"), IsNil)
+	c.Check(s.eval(c, ctx, "x30 + other + x10"), Equals, math.Pow(2, 11)+3+math.Pow(2, 10))
+	for i := 0; i <= 30; i++ {
+		expected := 1
+		if i >= 20 {
+			expected = 2
+		}
+		c.Check(s.calls[float64(i)], Equals, expected, Commentf("x%d", i))
+	}
+	c.Check(s.calls[100], Equals, 1)
+
+	ctx.Delete("x5")
+	e, err := Compile("x30")
+	c.Assert(err, IsNil)
+	res, err := e.Eval(ctx)
+	c.Check(err, IsNil)
+	c.Check(res, Equals, math.Pow(2, 11))
+	e, err = Compile("x10")
+	c.Assert(err, IsNil)
+	_, err = e.Eval(ctx)
+	c.Check(err, ErrorMatches, "in x10 -> x9 -> x8 -> x7 -> x6: Could not find 'x5' in CachedContext")
+
+	// defining a missing variable invalidates its dependents
+	c.Assert(ctx.CompileAndAdd("x5", "1"), IsNil)
+	c.Check(s.eval(c, ctx, "x10"), Equals, math.Pow(2, 5))
+}
+
+func (s *CacheSuite) TestImpureFunctionsAreNotMemoized(c *C) {
+	ctx := NewCachedContext()
+	c.Assert(ctx.CompileAndAdd("r", "rand()"), IsNil)
+	c.Assert(ctx.CompileAndAdd("a", "count(1, r + 1)"), IsNil)
+	c.Assert(ctx.CompileAndAdd("b", "count(2, 3)"), IsNil)
+
+	first := s.eval(c, ctx, "a + b")
+	second := s.eval(c, ctx, "a + b")
+	c.Check(first, Not(Equals), second)
+	c.Check(s.calls[1], Equals, 2)
+	c.Check(s.calls[2], Equals, 1)
+}
+
+func (s *CacheSuite) TestValuesDoNotDependOnScope(c *C) {
+	c.Assert(RegisterLazyFunction("withX", 2, func(args []Expression, ctx Context) (float64, error) {
+		scope := NewScopeContext(ctx)
+		value, err := args[0].Eval(ctx)
+		if err != nil {
+			return math.NaN(), err
+		}
+		scope.Set("x", value)
+		return args[1].Eval(scope)
+	}), IsNil)
+	defer UnregisterFunction("withX")
+
+	ctx := NewCachedContext()
+	c.Assert(ctx.CompileAndAdd("x", "1"), IsNil)
+	c.Assert(ctx.CompileAndAdd("a", "x * 10"), IsNil)
+	c.Check(s.eval(c, ctx, "withX(2, x + a)"), Equals, 12.0)
+	c.Check(s.eval(c, ctx, "a"), Equals, 10.0)
+
+	c.Assert(ctx.CompileAndAdd("loop", "withX(2, loop)"), IsNil)
+	e, err := Compile("loop")
+	c.Assert(err, IsNil)
+	_, err = e.Eval(ctx)
+	c.Check(err, ErrorMatches, "in loop -> loop: Got cyclic dependency loop -> loop")
+
+	c.Check(TransitiveDependencies(NewReference("a"), ctx), DeepEquals, []string{"a", "x"})
+	expr, err := ctx.GetExpression("a")
+	c.Assert(err, IsNil)
+	c.Check(fmt.Sprint(expr), Equals, "x * 10")
+}
+
+func (s *CacheSuite) TestConcurrentEvaluations(c *C) {
+	ctx := NewCachedContext()
+	c.Assert(ctx.CompileAndAdd("a", "count(1, b + 1)"), IsNil)
+	c.Assert(ctx.CompileAndAdd("b", "count(2, 2)"), IsNil)
+	e, err := Compile("a * b")
+	c.Assert(err, IsNil)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i == 25 {
+				ctx.CompileAndAdd("b", "count(2, 2)")
+			}
+			res, err := e.Eval(ctx)
+			if err != nil || res != 6.0 {
+				errs <- fmt.Errorf("got %v, %v", res, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Error(err)
+	}
+}
+
+func (s *CacheSuite) TestRewriteVariables(c *C) {
+	ctx := NewCachedContext()
+	c.Assert(ctx.CompileAndAdd("x", "2"), IsNil)
+	c.Assert(ctx.CompileAndAdd("a", "x * 1 + 0"), IsNil)
+	a, err := ctx.GetExpression("a")
+	c.Assert(err, IsNil)
+
+	simplified := Simplify(a)
+	c.Check(fmt.Sprint(simplified), Equals, "x")
+	c.Check(fmt.Sprint(a), Equals, "x * 1 + 0")
+
+	// still evaluated within the CachedContext, and up to date
+	res, err := simplified.Eval(nil)
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, 2.0)
+	c.Assert(ctx.CompileAndAdd("x", "3"), IsNil)
+	res, err = simplified.Eval(nil)
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, 3.0)
+}
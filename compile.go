@@ -5,6 +5,7 @@ import (
 	"io"
 	"math"
 	"math/rand"
+	"sort"
 	"strconv"
 )
 
@@ -34,6 +35,7 @@ const (
 	opStandard operatorType = iota
 	opFunction
 	opLeftParenthesis
+	opPrefix
 )
 
 type operator struct {
@@ -42,6 +44,17 @@ type operator struct {
 	precedence, card int
 	leftAssociative  bool
 	poper            queuePoper
+	// true for operators registered with the Impure option
+	impure bool
+	// location of the operator token in the input
+	pos Position
+	// for opFunction, the candidates resolved once the arguments are
+	// counted
+	overloads []function
+	// for opLeftParenthesis, if it opens a function call and the
+	// number of comma found so far
+	call  bool
+	comma int
 }
 
 type opStack struct {
@@ -67,146 +80,722 @@ func (o *opStack) unsafeTop() operator {
 }
 
 type function struct {
-	card    int
-	name    string
-	evaluer NEvaluer
+	// name of the function, without parenthese
+	name string
+	// accepted number of arguments, a negative maxCard means
+	// unbounded
+	minCard, maxCard int
+	evaluer          FallibleEvaluer
+	// if set, the function receives unevaluated arguments
+	lazy LazyEvaluer
+	// true if two calls with the same arguments may return
+	// different results, like rand()
+	impure bool
+	// true for built-in functions
+	builtin bool
+	// set by the Derivatives option
+	partials *partials
+	// differentiates a call, nil if not differentiable
+	derive deriver
 }
 
-func operatorFromFunction(f function) operator {
-	return operator{
-		oType: opFunction,
-		card:  f.card,
-		name:  f.name,
-		poper: func(out *outQueue) Expression {
-			//pop from the queue, is done before
-			res := &nExp{
-				card:     f.card,
-				children: make([]Expression, f.card),
-				evaluer:  f.evaluer,
-			}
-			for i := 0; i < f.card; i++ {
-				res.children[i] = out.unsafePop()
-			}
-			return res
-		},
+func (f function) accepts(card int) bool {
+	return card >= f.minCard && (f.maxCard < 0 || card <= f.maxCard)
+}
+
+func (f function) variadic() bool {
+	return f.minCard != f.maxCard
+}
+
+// poper returns the queuePoper of a call to f with card arguments
+func (f function) poper(card int) queuePoper {
+	if f.lazy != nil {
+		poper := poperForLazy(f.name, card, f.impure, f.lazy)
+		if f.builtin == false {
+			return poper
+		}
+		return func(output *outQueue) Expression {
+			return markBuiltin(poper(output))
+		}
+	}
+	return func(out *outQueue) Expression {
+		//pop from the queue, is done before
+		res := &nExp{
+			name:     f.name,
+			card:     card,
+			children: make([]Expression, card),
+			evaluer:  f.evaluer,
+			impure:   f.impure,
+			derive:   f.derive,
+		}
+		// last argument is on top of the queue
+		for i := card - 1; i >= 0; i-- {
+			res.children[i] = out.unsafePop()
+		}
+		return res
 	}
 }
 
-var operators = make(map[TokenType]operator)
-var functions = make(map[string]function)
+// resolveFunction returns the overload that accepts card arguments,
+// preferring non-variadic ones.
+func resolveFunction(name string, overloads []function, card int) (function, error) {
+	found := false
+	var res function
+	for _, f := range overloads {
+		if f.accepts(card) == false {
+			continue
+		}
+		if found == false || (res.variadic() == true && f.variadic() == false) {
+			res = f
+			found = true
+		}
+	}
+	if found == true {
+		return res, nil
+	}
+
+	return function{}, arityError(name, overloads, card)
+}
+
+// arityError reports the accepted number of arguments of the
+// overloads of a function.
+func arityError(name string, overloads []function, card int) *ArityError {
+	ranges := make([][2]int, len(overloads))
+	for i, f := range overloads {
+		ranges[i] = [2]int{f.minCard, f.maxCard}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	// merge the overlapping or contiguous ranges
+	merged := [][2]int{ranges[0]}
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if last[1] >= 0 && r[0] > last[1]+1 {
+			merged = append(merged, r)
+			continue
+		}
+		if last[1] >= 0 && (r[1] < 0 || r[1] > last[1]) {
+			last[1] = r[1]
+		}
+	}
+
+	err := &ArityError{
+		Name: name,
+		Min:  merged[0][0],
+		Max:  merged[len(merged)-1][1],
+		Got:  card,
+	}
+	if len(merged) > 1 {
+		err.Accepted = merged
+	}
+	return err
+}
 
-func poperForBinaryOperator(evaluer binaryEvaluer) queuePoper {
+func poperForBinaryOperator(name string, precedence int, leftAssociative bool, evaluer binaryEvaluer) queuePoper {
 	return func(output *outQueue) Expression {
 		return &binaryExp{
+			name:            name,
+			precedence:      precedence,
+			leftAssociative: leftAssociative,
+			evaluer:         evaluer,
+			rightChild:      output.unsafePop(),
+			leftChild:       output.unsafePop(),
+		}
+	}
+}
+
+func poperForUnaryOperator(name string, precedence int, evaluer unaryEvaluer) queuePoper {
+	return func(output *outQueue) Expression {
+		return &unaryExp{
+			name:       name,
+			precedence: precedence,
 			evaluer:    evaluer,
-			rightChild: output.unsafePop(),
-			leftChild:  output.unsafePop(),
+			child:      output.unsafePop(),
+		}
+	}
+}
+
+func poperForLazyOperator(name string, precedence int, leftAssociative bool, evaluer LazyEvaluer) queuePoper {
+	return func(output *outQueue) Expression {
+		return &lazyBinaryExp{
+			name:            name,
+			precedence:      precedence,
+			leftAssociative: leftAssociative,
+			evaluer:         evaluer,
+			rightChild:      output.unsafePop(),
+			leftChild:       output.unsafePop(),
+		}
+	}
+}
+
+func poperForLazy(name string, card int, impure bool, evaluer LazyEvaluer) queuePoper {
+	return func(output *outQueue) Expression {
+		res := &lazyExp{
+			name:     name,
+			children: make([]Expression, card),
+			evaluer:  evaluer,
+			impure:   impure,
+		}
+		for i := card - 1; i >= 0; i-- {
+			res.children[i] = output.unsafePop()
+		}
+		return res
+	}
+}
+
+// builtinOperator marks the nodes created by op as built-in ones,
+// whose semantics are known by Simplify
+func builtinOperator(op operator) operator {
+	poper := op.poper
+	op.poper = func(output *outQueue) Expression {
+		return markBuiltin(poper(output))
+	}
+	return op
+}
+
+// operatorOptions applies the options of a user operator. Only the
+// Impure option is supported.
+func operatorOptions(op operator, options []FunctionOption) (operator, error) {
+	f := function{name: op.name, minCard: op.card, maxCard: op.card}
+	for _, o := range options {
+		o(&f)
+	}
+	if f.partials != nil {
+		return op, fmt.Errorf("Operator '%s' cannot have partial derivatives", op.name)
+	}
+	if f.impure == false {
+		return op, nil
+	}
+	op.impure = true
+	poper := op.poper
+	op.poper = func(output *outQueue) Expression {
+		switch n := poper(output).(type) {
+		case *unaryExp:
+			n.impure = true
+			return n
+		case *binaryExp:
+			n.impure = true
+			return n
+		default:
+			return n
+		}
+	}
+	return op, nil
+}
+
+func markBuiltin(e Expression) Expression {
+	switch n := e.(type) {
+	case *unaryExp:
+		n.builtin = true
+	case *binaryExp:
+		n.builtin = true
+	case *lazyBinaryExp:
+		n.builtin = true
+	case *lazyExp:
+		n.builtin = true
+	}
+	return e
+}
+
+func (l *Language) registerOperator(t TokenType,
+	name string,
+	precedence int,
+	leftAssociative bool,
+	evaluer func(float64, float64) float64) error {
+	return l.registerFallibleOperator(t, name, precedence, leftAssociative,
+		func(a, b float64) (float64, error) { return evaluer(a, b), nil })
+}
+
+func (l *Language) registerFallibleOperator(t TokenType,
+	name string,
+	precedence int,
+	leftAssociative bool,
+	evaluer binaryEvaluer) error {
+	return l.registry.update(func(s *symbols) error {
+		if err := s.addToken(name, t); err != nil {
+			return err
 		}
+		return s.addOperator(t, builtinOperator(binaryOperator(name, precedence, leftAssociative, evaluer)))
+	})
+}
+
+func binaryOperator(name string,
+	precedence int,
+	leftAssociative bool,
+	evaluer binaryEvaluer) operator {
+	return operator{
+		oType:           opStandard,
+		name:            name,
+		poper:           poperForBinaryOperator(name, precedence, leftAssociative, evaluer),
+		precedence:      precedence,
+		leftAssociative: leftAssociative,
+		card:            2,
 	}
 }
 
-func registerOperator(t TokenType,
+func (l *Language) registerLazyOperator(t TokenType,
 	name string,
 	precedence int,
 	leftAssociative bool,
-	evaluer binaryEvaluer) {
-	operators[t] = operator{
+	evaluer LazyEvaluer) error {
+	return l.registry.update(func(s *symbols) error {
+		if err := s.addToken(name, t); err != nil {
+			return err
+		}
+		return s.addOperator(t, builtinOperator(lazyOperator(name, precedence, leftAssociative, evaluer)))
+	})
+}
+
+func lazyOperator(name string,
+	precedence int,
+	leftAssociative bool,
+	evaluer LazyEvaluer) operator {
+	return operator{
 		oType:           opStandard,
 		name:            name,
-		poper:           poperForBinaryOperator(evaluer),
+		poper:           poperForLazyOperator(name, precedence, leftAssociative, evaluer),
 		precedence:      precedence,
 		leftAssociative: leftAssociative,
 		card:            2,
 	}
 }
 
+func (l *Language) registerPrefixOperator(t TokenType,
+	name string,
+	precedence int,
+	evaluer func(float64) float64) error {
+	return l.registerFalliblePrefixOperator(t, name, precedence,
+		func(a float64) (float64, error) { return evaluer(a), nil })
+}
+
+func (l *Language) registerFalliblePrefixOperator(t TokenType,
+	name string,
+	precedence int,
+	evaluer unaryEvaluer) error {
+	return l.registry.update(func(s *symbols) error {
+		if err := s.addToken(name, t); err != nil {
+			return err
+		}
+		return s.addPrefixOperator(t, builtinOperator(prefixOperator(name, precedence, evaluer)))
+	})
+}
+
+func prefixOperator(name string,
+	precedence int,
+	evaluer unaryEvaluer) operator {
+	return operator{
+		oType:      opPrefix,
+		name:       name,
+		poper:      poperForUnaryOperator(name, precedence, evaluer),
+		precedence: precedence,
+		card:       1,
+	}
+}
+
 // RegisterFunction register a new function with the given
 // cardinality. The list of float passed to the evaluer function is
 // asserted to be cardinatily
-func RegisterFunction(name string, cardinality uint, evaluer NEvaluer) {
-	functions[name] = function{
-		card:    int(cardinality),
-		name:    name + "()",
-		evaluer: evaluer,
+//
+// A function could be overloaded by registering it several times
+// with different cardinality. Registering an existing cardinality
+// fails with a *ConflictError, UnregisterFunction should be called
+// first to replace a function.
+func (l *Language) RegisterFunction(name string, cardinality uint, evaluer NEvaluer, options ...FunctionOption) error {
+	return l.RegisterFallibleFunction(name, cardinality, infallible(evaluer), options...)
+}
+
+// RegisterFallibleFunction register a new function with the given
+// cardinality, that may fail. Errors returned, and panics raised, by
+// the evaluer are reported by Expression.Eval as a FunctionError.
+func (l *Language) RegisterFallibleFunction(name string, cardinality uint, evaluer FallibleEvaluer, options ...FunctionOption) error {
+	return l.RegisterVariadicFunction(name, int(cardinality), int(cardinality), evaluer, options...)
+}
+
+// RegisterVariadicFunction registers a new function that accepts
+// between minCard and maxCard arguments. A negative maxCard means
+// that there is no upper bound. The evaluer may fail like the one
+// passed to RegisterFallibleFunction.
+//
+// A variadic function could overload fixed ones with the same name,
+// the fixed one being preferred when both accept a call. It fails
+// with a *ConflictError if it overlaps another variadic overload,
+// and fails if maxCard is not negative but less than minCard.
+func (l *Language) RegisterVariadicFunction(name string, minCard, maxCard int, evaluer FallibleEvaluer, options ...FunctionOption) error {
+	if minCard < 0 {
+		minCard = 0
+	}
+	if maxCard >= 0 && maxCard < minCard {
+		return fmt.Errorf("'%s()' cannot accept between %d and %d arguments", name, minCard, maxCard)
 	}
+	f := function{
+		name:    name,
+		minCard: minCard,
+		maxCard: maxCard,
+		evaluer: protectEvaluer(name+"()", evaluer),
+	}
+	return l.addFunction(f, options)
 }
 
-func RegisterOperator(opToken string,
-	precedence int,
-	leftAssociative bool,
-	evaluer NEvaluer) error {
-	if err := registerOpToken(opToken, nextUserOperator); err != nil {
+// addFunction registers f once modified by options
+func (l *Language) addFunction(f function, options []FunctionOption) error {
+	for _, o := range options {
+		o(&f)
+	}
+	p := f.partials
+	if p != nil {
+		if f.variadic() == true || len(p.sources) != f.minCard {
+			return fmt.Errorf("'%s()' expects %d partial derivatives, got %d", f.name, f.minCard, len(p.sources))
+		}
+		f.derive = p.derive
+	}
+	return l.registry.update(func(s *symbols) error {
+		if err := s.addFunction(f.name, f); err != nil {
+			return err
+		}
+		if p == nil || f.builtin == true {
+			// built-in derivatives are compiled on first use with
+			// the built-in symbols
+			return nil
+		}
+		// f could be used in its own derivative
+		p.symbols = s
+		_, err := p.compile()
 		return err
+	})
+}
+
+// A FunctionOption sets optional properties of a function when it is
+// registered.
+type FunctionOption func(f *function)
+
+// Impure marks a registered function or operator whose result may
+// change between two calls with the same arguments, like
+// rand(). Functions and operators are otherwise assumed to be pure,
+// i.e. to only depend on their arguments. See IsDeterministic.
+func Impure(f *function) {
+	f.impure = true
+}
+
+// builtin marks a built-in function, whose semantics are known by
+// Simplify, and whose derivatives are compiled with the built-in
+// symbols
+func builtin(f *function) {
+	f.builtin = true
+}
+
+func infallible(evaluer NEvaluer) FallibleEvaluer {
+	return func(a []float64) (float64, error) {
+		return evaluer(a), nil
 	}
-	registerOperator(nextUserOperator,
-		opToken,
+}
+
+// RegisterLazyFunction registers a new function with the given
+// cardinality, that receives its arguments unevaluated, with the
+// Context of the evaluation. The list of Expression passed to the
+// evaluer is asserted to be of length cardinality.
+func (l *Language) RegisterLazyFunction(name string, cardinality uint, evaluer LazyEvaluer, options ...FunctionOption) error {
+	return l.addFunction(function{
+		name:    name,
+		minCard: int(cardinality),
+		maxCard: int(cardinality),
+		lazy:    protectLazyEvaluer(name+"()", evaluer),
+	}, options)
+}
+
+// RegisterOperator registers a new binary operator. The list of
+// float passed to the evaluer is asserted to be of length 2. It
+// fails with a *ConflictError if a binary operator is already
+// registered for opToken. Only the Impure option applies to
+// operators.
+func (l *Language) RegisterOperator(opToken string,
+	precedence int,
+	leftAssociative bool,
+	evaluer NEvaluer,
+	options ...FunctionOption) error {
+	return l.RegisterFallibleOperator(opToken, precedence, leftAssociative, infallible(evaluer), options...)
+}
+
+// RegisterFallibleOperator registers a new binary operator that may
+// fail. Errors returned, and panics raised, by the evaluer are
+// reported by Expression.Eval as a FunctionError.
+func (l *Language) RegisterFallibleOperator(opToken string,
+	precedence int,
+	leftAssociative bool,
+	evaluer FallibleEvaluer,
+	options ...FunctionOption) error {
+	evaluer = protectEvaluer(opToken, evaluer)
+	op, err := operatorOptions(binaryOperator(opToken,
 		precedence,
 		leftAssociative,
-		func(a, b float64) float64 { return evaluer([]float64{a, b}) })
+		func(a, b float64) (float64, error) { return evaluer([]float64{a, b}) }), options)
+	if err != nil {
+		return err
+	}
+	return l.registry.update(func(s *symbols) error {
+		t, err := s.userTokenType(opToken)
+		if err != nil {
+			return err
+		}
+		return s.addOperator(t, op)
+	})
+}
 
-	nextUserOperator++
-	return nil
+func (l *Language) MustRegisterOperator(opToken string,
+	precedence int,
+	leftAssociative bool,
+	evaluer NEvaluer,
+	options ...FunctionOption) {
+	if err := l.RegisterOperator(opToken, precedence, leftAssociative, evaluer, options...); err != nil {
+		panic("Cannot register operator " + opToken + " : " + err.Error())
+	}
 }
 
-func MustRegisterOperator(opToken string,
+func (l *Language) MustRegisterFallibleOperator(opToken string,
 	precedence int,
 	leftAssociative bool,
-	evaluer NEvaluer) {
-	if err := RegisterOperator(opToken, precedence, leftAssociative, evaluer); err != nil {
+	evaluer FallibleEvaluer,
+	options ...FunctionOption) {
+	if err := l.RegisterFallibleOperator(opToken, precedence, leftAssociative, evaluer, options...); err != nil {
 		panic("Cannot register operator " + opToken + " : " + err.Error())
 	}
 }
 
-var nextUserOperator = tokUserStart
+// RegisterPrefixOperator registers a new prefix unary operator, like
+// the built-in unary '-'. The token could be shared with a binary
+// operator, the parser uses the position of the token to choose
+// between both. The list of float passed to the evaluer is asserted
+// to be of length 1. It fails with a *ConflictError if a prefix
+// operator is already registered for opToken. Only the Impure
+// option applies to operators.
+func (l *Language) RegisterPrefixOperator(opToken string,
+	precedence int,
+	evaluer NEvaluer,
+	options ...FunctionOption) error {
+	protected := protectEvaluer(opToken, infallible(evaluer))
+	op, err := operatorOptions(prefixOperator(opToken,
+		precedence,
+		func(a float64) (float64, error) { return protected([]float64{a}) }), options)
+	if err != nil {
+		return err
+	}
+	return l.registry.update(func(s *symbols) error {
+		t, err := s.userTokenType(opToken)
+		if err != nil {
+			return err
+		}
+		if t == TokOParen || t == TokCParen || t == TokComma {
+			return fmt.Errorf("Cannot use %q as a prefix operator", opToken)
+		}
+		return s.addPrefixOperator(t, op)
+	})
+}
+
+func (l *Language) MustRegisterPrefixOperator(opToken string,
+	precedence int,
+	evaluer NEvaluer,
+	options ...FunctionOption) {
+	if err := l.RegisterPrefixOperator(opToken, precedence, evaluer, options...); err != nil {
+		panic("Cannot register prefix operator " + opToken + " : " + err.Error())
+	}
+}
 
-func init() {
-	registerOperator(TokPlus, "+", 2, true, func(a float64, b float64) float64 { return a + b })
-	registerOperator(TokMinus, "-", 2, true, func(a float64, b float64) float64 { return a - b })
-	registerOperator(TokMult, "*", 3, true, func(a float64, b float64) float64 { return a * b })
-	registerOperator(TokDivide, "/", 3, true, func(a float64, b float64) float64 { return a / b })
-	registerOperator(TokPower, "^", 4, false, func(a float64, b float64) float64 { return math.Pow(a, b) })
+func evalAnd(args []Expression, c Context) (float64, error) {
+	for _, a := range args {
+		v, err := a.Eval(c)
+		if err != nil {
+			return math.NaN(), err
+		}
+		if v == 0 {
+			return 0.0, nil
+		}
+	}
+	return 1.0, nil
+}
 
-	RegisterFunction("pi", 0, func(a []float64) float64 { return math.Pi })
-	RegisterFunction("rand", 0, func(a []float64) float64 { return rand.Float64() })
+func evalOr(args []Expression, c Context) (float64, error) {
+	for _, a := range args {
+		v, err := a.Eval(c)
+		if err != nil {
+			return math.NaN(), err
+		}
+		if v != 0 {
+			return 1.0, nil
+		}
+	}
+	return 0.0, nil
+}
+
+// evalIf only evaluates the taken branch
+func evalIf(args []Expression, c Context) (float64, error) {
+	cond, err := args[0].Eval(c)
+	if err != nil {
+		return math.NaN(), err
+	}
+	if cond != 0 {
+		return args[1].Eval(c)
+	}
+	return args[2].Eval(c)
+}
+
+// prefixPrecedence is the precedence of built-in prefix
+// operators. They binds tighter than '*', but not than '^', so -2^2
+// == -4
+const prefixPrecedence = 4
 
-	RegisterFunction("sin", 1, func(a []float64) float64 { return math.Sin(a[0]) })
-	RegisterFunction("cos", 1, func(a []float64) float64 { return math.Cos(a[0]) })
-	RegisterFunction("tan", 1, func(a []float64) float64 { return math.Tan(a[0]) })
-	RegisterFunction("asin", 1, func(a []float64) float64 { return math.Asin(a[0]) })
-	RegisterFunction("acos", 1, func(a []float64) float64 { return math.Acos(a[0]) })
-	RegisterFunction("atan", 1, func(a []float64) float64 { return math.Atan(a[0]) })
-	RegisterFunction("sqrt", 1, func(a []float64) float64 { return math.Sqrt(a[0]) })
-	RegisterFunction("exp", 1, func(a []float64) float64 { return math.Exp(a[0]) })
-	RegisterFunction("ln", 1, func(a []float64) float64 { return math.Log(a[0]) })
-	RegisterFunction("log", 1, func(a []float64) float64 { return math.Log10(a[0]) })
-	RegisterFunction("ceil", 1, func(a []float64) float64 { return math.Ceil(a[0]) })
-	RegisterFunction("floor", 1, func(a []float64) float64 { return math.Floor(a[0]) })
+func boolToFloat(b bool) float64 {
+	if b == true {
+		return 1.0
+	}
+	return 0.0
+}
+
+func init() {
+	l := defaultLanguage
+	l.registerOperator(TokPlus, "+", 2, true, func(a float64, b float64) float64 { return a + b })
+	l.registerOperator(TokMinus, "-", 2, true, func(a float64, b float64) float64 { return a - b })
+	l.registerOperator(TokMult, "*", 3, true, func(a float64, b float64) float64 { return a * b })
+	l.registerOperator(TokDivide, "/", 3, true, func(a float64, b float64) float64 { return a / b })
+	l.registerOperator(TokPower, "^", 4, false, func(a float64, b float64) float64 { return math.Pow(a, b) })
+	// comparisons evaluates to 1.0 if true, 0.0 otherwise
+	l.registerOperator(TokLess, "<", 1, true, func(a float64, b float64) float64 { return boolToFloat(a < b) })
+	l.registerOperator(TokLessEqual, "<=", 1, true, func(a float64, b float64) float64 { return boolToFloat(a <= b) })
+	l.registerOperator(TokGreater, ">", 1, true, func(a float64, b float64) float64 { return boolToFloat(a > b) })
+	l.registerOperator(TokGreaterEqual, ">=", 1, true, func(a float64, b float64) float64 { return boolToFloat(a >= b) })
+	l.registerOperator(TokEqual, "==", 1, true, func(a float64, b float64) float64 { return boolToFloat(a == b) })
+	l.registerOperator(TokNotEqual, "!=", 1, true, func(a float64, b float64) float64 { return boolToFloat(a != b) })
+	// logical operators are short-circuiting, any non-zero value is
+	// true
+	l.registerLazyOperator(TokAnd, "&&", 0, true, evalAnd)
+	l.registerLazyOperator(TokOr, "||", -1, true, evalOr)
+	l.registerPrefixOperator(TokMinus, "-", prefixPrecedence, func(a float64) float64 { return -a })
+	l.registerPrefixOperator(TokPlus, "+", prefixPrecedence, func(a float64) float64 { return a })
+	l.registerPrefixOperator(TokNot, "!", prefixPrecedence, func(a float64) float64 { return boolToFloat(a == 0) })
+
+	l.RegisterFunction("pi", 0, func(a []float64) float64 { return math.Pi }, builtin)
+	l.RegisterFunction("rand", 0, func(a []float64) float64 { return rand.Float64() }, Impure)
+
+	l.RegisterFunction("sin", 1, func(a []float64) float64 { return math.Sin(a[0]) }, builtin, Derivatives("cos(x1)"))
+	l.RegisterFunction("cos", 1, func(a []float64) float64 { return math.Cos(a[0]) }, builtin, Derivatives("-sin(x1)"))
+	l.RegisterFunction("tan", 1, func(a []float64) float64 { return math.Tan(a[0]) }, builtin, Derivatives("1 + tan(x1)^2"))
+	l.RegisterFunction("asin", 1, func(a []float64) float64 { return math.Asin(a[0]) }, builtin, Derivatives("1 / sqrt(1 - x1^2)"))
+	l.RegisterFunction("acos", 1, func(a []float64) float64 { return math.Acos(a[0]) }, builtin, Derivatives("-1 / sqrt(1 - x1^2)"))
+	l.RegisterFunction("atan", 1, func(a []float64) float64 { return math.Atan(a[0]) }, builtin, Derivatives("1 / (1 + x1^2)"))
+	l.RegisterFunction("sqrt", 1, func(a []float64) float64 { return math.Sqrt(a[0]) }, builtin, Derivatives("1 / (2 * sqrt(x1))"))
+	l.RegisterFunction("exp", 1, func(a []float64) float64 { return math.Exp(a[0]) }, builtin, Derivatives("exp(x1)"))
+	l.RegisterFunction("ln", 1, func(a []float64) float64 { return math.Log(a[0]) }, builtin, Derivatives("1 / x1"))
+	l.RegisterFunction("log", 1, func(a []float64) float64 { return math.Log10(a[0]) }, builtin, Derivatives("1 / (x1 * ln(10))"))
+	l.RegisterFunction("ceil", 1, func(a []float64) float64 { return math.Ceil(a[0]) }, builtin, Derivatives("0"))
+	l.RegisterFunction("floor", 1, func(a []float64) float64 { return math.Floor(a[0]) }, builtin, Derivatives("0"))
+
+	l.RegisterFunction("atan2", 2, func(a []float64) float64 { return math.Atan2(a[0], a[1]) }, builtin,
+		Derivatives("x2 / (x1^2 + x2^2)", "-x1 / (x1^2 + x2^2)"))
+
+	l.RegisterVariadicFunction("min", 1, -1, func(a []float64) (float64, error) {
+		res := a[0]
+		for _, v := range a[1:] {
+			res = math.Min(res, v)
+		}
+		return res, nil
+	}, builtin, derivedBy(deriveExtremum))
+	l.RegisterVariadicFunction("max", 1, -1, func(a []float64) (float64, error) {
+		res := a[0]
+		for _, v := range a[1:] {
+			res = math.Max(res, v)
+		}
+		return res, nil
+	}, builtin, derivedBy(deriveExtremum))
+	l.RegisterVariadicFunction("sum", 1, -1, func(a []float64) (float64, error) {
+		res := 0.0
+		for _, v := range a {
+			res += v
+		}
+		return res, nil
+	}, builtin, derivedBy(deriveSum))
 
-	RegisterFunction("atan2", 2, func(a []float64) float64 { return math.Atan2(a[0], a[1]) })
+	l.RegisterLazyFunction("if", 3, evalIf, builtin)
 
+	builtins = l.registry.load()
 }
 
-func popOperatorFromStack(output *outQueue, stack *opStack) error {
+func popOperatorFromStack(input string, output *outQueue, stack *opStack) error {
 	/*	if stack.size() == 0 {
 		return fmt.Errorf("Internal expression compilation error, stack should not be emptyin popOperatorFromStack")
 	} */
 	op := stack.unsafePop()
 	if output.size() < op.card {
-		return fmt.Errorf("Evaluation stack error for '%s', need %d element, but only %d provided",
-			op.name,
-			op.card,
-			output.size())
+		return newParseError(input, op.pos, &ArityError{
+			Name: op.name,
+			Min:  op.card,
+			Max:  op.card,
+			Got:  output.size(),
+		})
 	}
 	//will pop the stack and push it
 	output.push(op.poper(output))
 	return nil
 }
 
-func buildAST(input string) (Expression, error) {
-	l := NewLexer(input)
+// pushOperator pushes a binary operator on the stack, popping before
+// all operators that have a greater precedence.
+func pushOperator(input string, op1 operator, output *outQueue, stack *opStack) error {
+	for stack.size() > 0 {
+		op2 := stack.unsafeTop()
+		if op2.oType != opStandard && op2.oType != opPrefix {
+			break
+		}
+
+		if op1.precedence < op2.precedence {
+			if err := popOperatorFromStack(input, output, stack); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if op1.leftAssociative && op1.precedence == op2.precedence {
+			if err := popOperatorFromStack(input, output, stack); err != nil {
+				return err
+			}
+			continue
+		}
+
+		break
+	}
+	stack.push(op1)
+	return nil
+}
+
+// splitSign splits the sign the Lexer may have glued to a number
+func splitSign(value string) (string, string, bool) {
+	if len(value) > 1 && (value[0] == '+' || value[0] == '-') {
+		return value[:1], value[1:], true
+	}
+	return "", value, false
+}
+
+// popFunctionCall pops the function call whose closing parenthesis
+// was just found, with its card arguments.
+func popFunctionCall(input string, card int, output *outQueue, stack *opStack) error {
+	op := stack.unsafeTop()
+	f, err := resolveFunction(op.name, op.overloads, card)
+	if err != nil {
+		return newParseError(input, op.pos, err)
+	}
+	stack.unsafePop()
+	op.card = card
+	op.poper = f.poper(card)
+	stack.push(op)
+	return popOperatorFromStack(input, output, stack)
+}
+
+func buildAST(input string, symbols *symbols) (Expression, error) {
+	l := newLexer(input, symbols)
 
 	output := outQueue{}
 	stack := opStack{}
+	// true when the next token should be an operand, i.e. an
+	// operator found there is a prefix operator.
+	expectOperand := true
+	// true when the previous token is a function name
+	expectCall := false
 
 	for {
 		t, err := l.Next()
@@ -218,109 +807,181 @@ func buildAST(input string) (Expression, error) {
 			return nil, err
 		}
 
+		if expectCall == true && t.Type != TokOParen {
+			fn := stack.unsafeTop()
+			return nil, newSyntaxError(input, fn.pos, "Function '%s' called without parenthese", fn.name)
+		}
+		expectCall = false
+
 		if t.Type == TokValue {
+			if _, _, signed := splitSign(t.Value); signed == false && expectOperand == false {
+				return nil, newSyntaxError(input, t.Pos, "Missing operator before '%s'", t.Value)
+			}
+			// the Lexer glues the sign to the number, we split it
+			// here as it is either a prefix or a binary operator.
+			if sign, unsigned, ok := splitSign(t.Value); ok == true {
+				signType, known := symbols.tokens[sign]
+				signPos := t.Pos
+				signPos.Length = 1
+				t.Pos = t.Pos.advance(t.Value[:1])
+				t.Pos.Length = len(unsigned)
+				if expectOperand == true {
+					op, ok := symbols.prefixOperators[signType]
+					if known == false || ok == false {
+						return nil, newSyntaxError(input, signPos, "Operator '%s' is not yet implemented", sign)
+					}
+					op.pos = signPos
+					stack.push(op)
+				} else {
+					op, ok := symbols.operators[signType]
+					if known == false || ok == false {
+						return nil, newSyntaxError(input, signPos, "Operator '%s' is not yet implemented", sign)
+					}
+					op.pos = signPos
+					if err := pushOperator(input, op, &output, &stack); err != nil {
+						return nil, err
+					}
+				}
+				t.Value = unsigned
+			}
 			if value, err := strconv.ParseFloat(t.Value, 64); err != nil {
-				return nil, fmt.Errorf("Internal Lexer error. Lexer gave us value %s, but strconv.Float64 cannot convert it : %s", t.Value, err)
+				return nil, newSyntaxError(input, t.Pos, "Internal Lexer error. Lexer gave us value %s, but strconv.Float64 cannot convert it : %s", t.Value, err)
 			} else {
 				output.push(&valueExp{value: value})
 			}
+			expectOperand = false
 			continue
 		}
 
 		// checks for a function or a number
 		if t.Type == TokIdent {
-			if fn, ok := functions[t.Value]; ok == true {
-				stack.push(operatorFromFunction(fn))
+			if expectOperand == false {
+				return nil, newSyntaxError(input, t.Pos, "Missing operator before '%s'", t.Value)
+			}
+			if overloads, ok := symbols.functions[t.Value]; ok == true {
+				stack.push(operator{
+					oType:     opFunction,
+					name:      t.Value + "()",
+					pos:       t.Pos,
+					overloads: overloads,
+				})
+				expectOperand = true
+				expectCall = true
 			} else {
 				output.push(&refExp{variable: t.Value})
+				expectOperand = false
 			}
 			continue
 		}
 
 		if t.Type == TokComma {
+			if expectOperand == true {
+				return nil, newSyntaxError(input, t.Pos, "Missing operand before ','")
+			}
 			for stack.size() > 0 && stack.unsafeTop().oType != opLeftParenthesis {
-				if err := popOperatorFromStack(&output, &stack); err != nil {
+				if err := popOperatorFromStack(input, &output, &stack); err != nil {
 					return nil, err
 				}
 			}
 
-			if stack.size() == 0 || stack.unsafeTop().oType != opLeftParenthesis {
-				return nil, fmt.Errorf("Misplaced comma or mismatched parenthese in %s", input)
+			if stack.size() == 0 || stack.unsafeTop().call == false {
+				return nil, newSyntaxError(input, t.Pos, "Misplaced comma or mismatched parenthese in %s", input)
 			}
+			stack.s[stack.size()-1].comma++
+			expectOperand = true
 			continue
 		}
 
 		//get the operator from the token
+		if op1, ok := symbols.prefixOperators[t.Type]; ok == true && expectOperand == true {
+			// prefix operators have nothing on their left to pop
+			op1.pos = t.Pos
+			stack.push(op1)
+			continue
+		}
 
-		if op1, ok := operators[t.Type]; ok == true {
-			for stack.size() > 0 {
-				op2 := stack.unsafeTop()
-				if op2.oType != opStandard {
-					break
-				}
-
-				if op1.precedence < op2.precedence {
-					if err = popOperatorFromStack(&output, &stack); err != nil {
-						return nil, err
-					}
-					continue
-				}
-
-				if op1.leftAssociative && op1.precedence == op2.precedence {
-					if err = popOperatorFromStack(&output, &stack); err != nil {
-						return nil, err
-					}
-					continue
-				}
-
-				break
+		if op1, ok := symbols.operators[t.Type]; ok == true {
+			if expectOperand == true {
+				return nil, newSyntaxError(input, t.Pos, "Missing operand before '%s'", t.Value)
 			}
-			stack.push(op1)
+			op1.pos = t.Pos
+			if err := pushOperator(input, op1, &output, &stack); err != nil {
+				return nil, err
+			}
+			expectOperand = true
 			continue
 		}
 
 		if t.Type == TokOParen {
+			// a call follows its function name, where an operand is
+			// still expected
+			if expectOperand == false {
+				return nil, newSyntaxError(input, t.Pos, "Missing operator before '%s'", t.Value)
+			}
 			stack.push(operator{
 				oType: opLeftParenthesis,
 				poper: nil,
+				pos:   t.Pos,
+				call:  stack.size() > 0 && stack.unsafeTop().oType == opFunction,
 			})
+			expectOperand = true
 			continue
 		}
 
 		if t.Type == TokCParen {
+			// an empty pair of parenthese is only valid for a call
+			// without arguments
+			empty := stack.size() > 0 && stack.unsafeTop().oType == opLeftParenthesis && stack.unsafeTop().comma == 0
+			if expectOperand == true && (empty == false || stack.unsafeTop().call == false) {
+				return nil, newSyntaxError(input, t.Pos, "Missing operand before ')'")
+			}
 			for stack.size() > 0 && stack.unsafeTop().oType != opLeftParenthesis {
-				if err := popOperatorFromStack(&output, &stack); err != nil {
+				if err := popOperatorFromStack(input, &output, &stack); err != nil {
 					return nil, err
 				}
 			}
 			if stack.size() == 0 {
-				return nil, fmt.Errorf("Mismatched parenthese in %s", input)
+				return nil, newSyntaxError(input, t.Pos, "Mismatched parenthese in %s", input)
 			}
-			stack.unsafePop()
-			// pop the next if this is a function
-			if stack.size() > 0 && stack.unsafeTop().oType == opFunction {
-				if err := popOperatorFromStack(&output, &stack); err != nil {
+			paren := stack.unsafePop()
+			if paren.call == true {
+				card := paren.comma + 1
+				if expectOperand == true {
+					card = 0
+				}
+				if err := popFunctionCall(input, card, &output, &stack); err != nil {
 					return nil, err
 				}
 			}
+			expectOperand = false
 			continue
 		}
 
-		return nil, fmt.Errorf("Operator '%s' is not yet implemented", t.Value)
+		return nil, newSyntaxError(input, t.Pos, "Operator '%s' is not yet implemented", t.Value)
+
+	}
+
+	if expectCall == true {
+		fn := stack.unsafeTop()
+		return nil, newSyntaxError(input, fn.pos, "Function '%s' called without parenthese", fn.name)
+	}
 
+	if expectOperand == true {
+		return nil, newSyntaxError(input, positionAt(input, len(input), 0), "Unexpected end of input")
 	}
 
 	for stack.size() > 0 {
 		if stack.unsafeTop().oType == opLeftParenthesis {
-			return nil, fmt.Errorf("Mismatched parenthese in %s", input)
+			return nil, newSyntaxError(input, stack.unsafeTop().pos, "Mismatched parenthese in %s", input)
 		}
-		if err := popOperatorFromStack(&output, &stack); err != nil {
+		if err := popOperatorFromStack(input, &output, &stack); err != nil {
 			return nil, err
 		}
 	}
 
 	if output.size() != 1 {
-		return nil, fmt.Errorf("Evaluation stack error, still got %d element instead of 1 at the final state",
+		return nil, newSyntaxError(input, positionAt(input, len(input), 0),
+			"Evaluation stack error, still got %d element instead of 1 at the final state",
 			output.size())
 	}
 
@@ -1,23 +1,21 @@
 package meval
 
-import "fmt"
-
-type callStack interface {
-	push(e *refExp)
-	pop()
-	testStack(e *refExp) (bool, []string)
-}
-
 // A Context is a kind of dictionnary of expression. You can pass it
 // to Eval.
+//
+// A Context holds no evaluation state, a single Context can be used
+// by concurrent evaluations as long as its GetExpression method is
+// safe for concurrent use.
 type Context interface {
 	// Returns an expression from a given name.
 	GetExpression(string) (Expression, error)
-	callStack
 }
 
-// CallStack is meant to be embedded in any type that want to
-// implement Context
+// CallStack is the stack of references followed by an evaluation,
+// used to detect cyclic dependencies.
+//
+// Deprecated: a Context no longer needs to embed a CallStack, each
+// evaluation maintains its own.
 type CallStack struct {
 	stack []*refExp
 }
@@ -47,13 +45,125 @@ func (c *CallStack) testStack(e *refExp) (bool, []string) {
 	return res, deps
 }
 
+// evalFrame is the Context passed down by an evaluation, it holds
+// the evaluation state on top of the user Context.
+type evalFrame struct {
+	Context
+	stack *CallStack
+}
+
+// frameOf returns the evalFrame to use for an evaluation within c,
+// creating a new one if c is not already part of an evaluation.
+func frameOf(c Context) *evalFrame {
+	switch f := c.(type) {
+	case *evalFrame:
+		return f
+	case *ScopeContext:
+		if parent := f.frame(); parent != nil {
+			return &evalFrame{Context: c, stack: parent.stack}
+		}
+	}
+	return &evalFrame{Context: c, stack: &CallStack{}}
+}
+
+// bindArguments wraps the arguments of a lazy call, so they are
+// evaluated with the call stack of the call, even within a Context
+// built by the LazyEvaluer. The wrappers keep the node interface of
+// the argument, but their children are not wrapped.
+func bindArguments(args []Expression, stack *CallStack) []Expression {
+	res := make([]Expression, len(args))
+	for i, a := range args {
+		switch n := a.(type) {
+		case ValueNode:
+			// cannot reference any variable
+			res[i] = a
+		case ReferenceNode:
+			res[i] = &boundReference{n, stack}
+		case OperatorNode:
+			res[i] = &boundOperator{n, stack}
+		case CallNode:
+			res[i] = &boundCall{n, stack}
+		default:
+			res[i] = &boundExpression{a, stack}
+		}
+	}
+	return res
+}
+
+// evalWithStack evaluates e within c, using stack as call stack
+func evalWithStack(e Expression, c Context, stack *CallStack) (float64, error) {
+	if c == nil {
+		return e.Eval(nil)
+	}
+	if f, ok := c.(*evalFrame); ok == true && f.stack == stack {
+		return e.Eval(c)
+	}
+	return e.Eval(&evalFrame{Context: c, stack: stack})
+}
+
+type boundExpression struct {
+	Expression
+	stack *CallStack
+}
+
+func (e *boundExpression) Eval(c Context) (float64, error) {
+	return evalWithStack(e.Expression, c, e.stack)
+}
+
+func (e *boundExpression) String() string {
+	return format(e.Expression)
+}
+
+type boundReference struct {
+	ReferenceNode
+	stack *CallStack
+}
+
+func (e *boundReference) Eval(c Context) (float64, error) {
+	return evalWithStack(e.ReferenceNode, c, e.stack)
+}
+
+func (e *boundReference) String() string {
+	return format(e.ReferenceNode)
+}
+
+type boundOperator struct {
+	OperatorNode
+	stack *CallStack
+}
+
+func (e *boundOperator) Eval(c Context) (float64, error) {
+	return evalWithStack(e.OperatorNode, c, e.stack)
+}
+
+func (e *boundOperator) String() string {
+	return format(e.OperatorNode)
+}
+
+type boundCall struct {
+	CallNode
+	stack *CallStack
+}
+
+func (e *boundCall) Eval(c Context) (float64, error) {
+	return evalWithStack(e.CallNode, c, e.stack)
+}
+
+func (e *boundCall) String() string {
+	return format(e.CallNode)
+}
+
 // MapContext represents the most simple context, aka a dictionnary of
 // expressions.
+//
+// A MapContext can be used by concurrent evaluations, but must not be
+// modified concurrently.
 type MapContext struct {
-	// In order to be a Context, one should embed a CallStack
-	CallStack
-
 	exprs map[string]Expression
+
+	// direct dependencies of each variable, only maintained if
+	// cycles are detected at insertion
+	deps map[string][]string
 }
 
 // NewMapContext creates a MapContext
@@ -66,28 +176,199 @@ func (c *MapContext) GetExpression(name string) (Expression, error) {
 	if e, ok := c.exprs[name]; ok == true {
 		return e, nil
 	}
-	return nil, fmt.Errorf("Could not find '%s' in MapContext", name)
+	return nil, &UndefinedVariableError{Name: name, Context: "MapContext"}
 }
 
-// Add adds a new expression to the MapContext
-func (c *MapContext) Add(name string, e Expression) {
+// Add adds a new expression to the MapContext. If cycles are detected
+// at insertion (see DetectCycles), it returns a
+// *CyclicDependencyError if e would create a cyclic dependency, and
+// the MapContext is left unchanged. Otherwise it always returns nil.
+func (c *MapContext) Add(name string, e Expression) error {
+	if c.deps != nil {
+		deps := Dependencies(e)
+		if cycle := c.findPath(deps, name); cycle != nil {
+			return &CyclicDependencyError{Cycle: append([]string{name}, cycle...)}
+		}
+		c.deps[name] = deps
+	}
 	c.exprs[name] = e
+	return nil
 }
 
 // CompileAndAdd compiles and adds a new expression to the MapContext.
 //
-// It returns the same errors than Compile()
+// It returns the same errors than Compile() and Add()
 func (c *MapContext) CompileAndAdd(name, input string) error {
 	if e, err := Compile(input); err != nil {
 		return err
 	} else {
-		c.Add(name, e)
+		return c.Add(name, e)
 	}
-	return nil
 }
 
 // Delete deletes the given expression from the MapContext if it
 // exists.
 func (c *MapContext) Delete(name string) {
 	delete(c.exprs, name)
+	if c.deps != nil {
+		delete(c.deps, name)
+	}
+}
+
+// DetectCycles makes the MapContext maintain a dependency graph of
+// its expressions, so Add rejects any expression that would create a
+// cyclic dependency. It fails with a *CyclicDependencyError if the
+// MapContext already contains a cycle.
+func (c *MapContext) DetectCycles() error {
+	if c.deps != nil {
+		return nil
+	}
+	if _, err := c.TopologicalOrder(); err != nil {
+		return err
+	}
+	c.deps = make(map[string][]string, len(c.exprs))
+	for name, e := range c.exprs {
+		c.deps[name] = Dependencies(e)
+	}
+	return nil
+}
+
+// dependencies returns the direct dependencies of a variable
+func (c *MapContext) dependencies(name string) []string {
+	if c.deps != nil {
+		return c.deps[name]
+	}
+	if e, ok := c.exprs[name]; ok == true {
+		return Dependencies(e)
+	}
+	return nil
+}
+
+// findPath returns a path of dependencies from one of the variables
+// in from to target, or nil if there is none.
+func (c *MapContext) findPath(from []string, target string) []string {
+	visited := make(map[string]bool)
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		if name == target {
+			return []string{name}
+		}
+		if visited[name] == true {
+			return nil
+		}
+		visited[name] = true
+		for _, d := range c.dependencies(name) {
+			if path := visit(d); path != nil {
+				return append([]string{name}, path...)
+			}
+		}
+		return nil
+	}
+
+	for _, name := range from {
+		if path := visit(name); path != nil {
+			return path
+		}
+	}
+	return nil
+}
+
+// TopologicalOrder returns the variables defined in the MapContext,
+// ordered such as each variable comes after all the variables it
+// depends on. It returns a *CyclicDependencyError if there is a
+// cyclic dependency.
+func (c *MapContext) TopologicalOrder() ([]string, error) {
+	res := make([]string, 0, len(c.exprs))
+	// a variable is either being visited (false), or done (true)
+	state := make(map[string]bool, len(c.exprs))
+	var path []string
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		if done, seen := state[name]; seen == true {
+			if done == true {
+				return nil
+			}
+			start := len(path) - 1
+			for ; path[start] != name; start-- {
+			}
+			return &CyclicDependencyError{
+				Cycle: append(append([]string(nil), path[start:]...), name),
+			}
+		}
+		if _, defined := c.exprs[name]; defined == false {
+			return nil
+		}
+		state[name] = false
+		path = append(path, name)
+		for _, d := range c.dependencies(name) {
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = true
+		res = append(res, name)
+		return nil
+	}
+
+	for _, name := range sortedNames(c.exprs) {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// ScopeContext overlays local variables on top of a parent
+// Context. It is meant to be used by LazyEvaluer that binds
+// variables, like a 'sum(i, 1, 10, i^2)' function.
+type ScopeContext struct {
+	parent Context
+	locals map[string]Expression
+}
+
+// NewScopeContext creates a ScopeContext on top of parent, that could
+// be nil.
+func NewScopeContext(parent Context) *ScopeContext {
+	return &ScopeContext{
+		parent: parent,
+		locals: make(map[string]Expression),
+	}
+}
+
+// GetExpression returns the local Expression with the given name, or
+// looks up the parent Context.
+func (c *ScopeContext) GetExpression(name string) (Expression, error) {
+	if e, ok := c.locals[name]; ok == true {
+		return e, nil
+	}
+	if c.parent != nil {
+		return c.parent.GetExpression(name)
+	}
+	return nil, &UndefinedVariableError{Name: name, Context: "ScopeContext"}
+}
+
+// Add adds a local Expression, hiding any parent one with the same
+// name.
+func (c *ScopeContext) Add(name string, e Expression) {
+	c.locals[name] = e
+}
+
+// Set binds a local variable to the given value
+func (c *ScopeContext) Set(name string, value float64) {
+	c.Add(name, &valueExp{value: value})
+}
+
+// frame returns the evaluation frame of the parent, if any. The call
+// stack is shared with the parent, so cycles going through the scope
+// are detected.
+func (c *ScopeContext) frame() *evalFrame {
+	switch p := c.parent.(type) {
+	case *evalFrame:
+		return p
+	case *ScopeContext:
+		return p.frame()
+	}
+	return nil
 }
@@ -1,6 +1,9 @@
 package meval
 
 import (
+	"fmt"
+	"sync"
+
 	. "gopkg.in/check.v1"
 )
 
@@ -26,5 +29,154 @@ func (s *ContextSuite) TestInvalidPushWillPanic(c *C) {
 		}
 		c.Check(didPanic, Equals, true)
 	}()
-	s.c.pop()
+	(&CallStack{}).pop()
+}
+
+func (s *ContextSuite) TestDetectCyclesAtInsertion(c *C) {
+	ctx := NewMapContext()
+	c.Assert(ctx.CompileAndAdd("a", "b + 1"), IsNil)
+	c.Assert(ctx.CompileAndAdd("b", "c * d"), IsNil)
+	c.Assert(ctx.DetectCycles(), IsNil)
+
+	c.Check(ctx.CompileAndAdd("c", "2 * d"), IsNil)
+	c.Check(ctx.CompileAndAdd("d", "1"), IsNil)
+
+	err := ctx.CompileAndAdd("d", "sqrt(a)")
+	c.Assert(err, Not(IsNil))
+	cerr, ok := err.(*CyclicDependencyError)
+	c.Assert(ok, Equals, true)
+	c.Check(cerr.Cycle, DeepEquals, []string{"d", "a", "b", "c", "d"})
+
+	err = ctx.CompileAndAdd("e", "e + 1")
+	c.Check(err, ErrorMatches, "Got cyclic dependency e -> e")
+
+	// rejected expression are not added
+	res, err := Compile("a")
+	c.Assert(err, IsNil)
+	v, err := res.Eval(ctx)
+	c.Assert(err, IsNil)
+	c.Check(v, Equals, 3.0)
+	_, err = ctx.GetExpression("e")
+	c.Check(err, Not(IsNil))
+
+	// once the link is removed, there is no more cycle
+	ctx.Delete("b")
+	c.Check(ctx.CompileAndAdd("d", "sqrt(a)"), IsNil)
+}
+
+func (s *ContextSuite) TestDetectCyclesFailsOnExistingCycle(c *C) {
+	ctx := NewMapContext()
+	c.Assert(ctx.CompileAndAdd("a", "b + 1"), IsNil)
+	c.Assert(ctx.CompileAndAdd("b", "a"), IsNil)
+
+	err := ctx.DetectCycles()
+	c.Check(err, ErrorMatches, "Got cyclic dependency a -> b -> a")
+
+	_, err = ctx.TopologicalOrder()
+	c.Check(err, ErrorMatches, "Got cyclic dependency a -> b -> a")
+}
+
+func (s *ContextSuite) TestTopologicalOrder(c *C) {
+	ctx := NewMapContext()
+	defs := map[string]string{
+		"speed":    "distance / time",
+		"distance": "2 * radius * pi()",
+		"radius":   "3.0",
+		"time":     "max(offset, 1)",
+		"offset":   "radius - 1",
+		"alone":    "undefined",
+	}
+	for name, input := range defs {
+		c.Assert(ctx.CompileAndAdd(name, input), IsNil)
+	}
+
+	order, err := ctx.TopologicalOrder()
+	c.Assert(err, IsNil)
+	c.Check(order, DeepEquals, []string{"alone", "radius", "distance", "offset", "time", "speed"})
+
+	c.Assert(ctx.DetectCycles(), IsNil)
+	order, err = ctx.TopologicalOrder()
+	c.Assert(err, IsNil)
+	c.Check(order, DeepEquals, []string{"alone", "radius", "distance", "offset", "time", "speed"})
+}
+
+func (s *ContextSuite) TestConcurrentEvaluations(c *C) {
+	ctx := NewMapContext()
+	c.Assert(ctx.CompileAndAdd("a", "b + c"), IsNil)
+	c.Assert(ctx.CompileAndAdd("b", "2 * c"), IsNil)
+	c.Assert(ctx.CompileAndAdd("c", "3"), IsNil)
+	c.Assert(ctx.CompileAndAdd("d", "e + 1"), IsNil)
+	c.Assert(ctx.CompileAndAdd("e", "d * 2"), IsNil)
+
+	a, err := Compile("a + b")
+	c.Assert(err, IsNil)
+	d, err := Compile("d")
+	c.Assert(err, IsNil)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 200)
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			v, err := a.Eval(ctx)
+			if err != nil || v != 15.0 {
+				errs <- fmt.Errorf("got %v, %v", v, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := d.Eval(ctx)
+			if err == nil || err.Error() != "in d -> e -> d: Got cyclic dependency d -> e -> d" {
+				errs <- fmt.Errorf("unexpected error %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Error(err)
+	}
+}
+
+// withContext binds a single variable on top of a Context, like a
+// user Context built by a LazyEvaluer would
+type withContext struct {
+	Context
+	name  string
+	value float64
+}
+
+func (c *withContext) GetExpression(name string) (Expression, error) {
+	if name == c.name {
+		return NewValue(c.value), nil
+	}
+	return c.Context.GetExpression(name)
+}
+
+func (s *ContextSuite) TestDetectCyclesThroughUserContext(c *C) {
+	c.Assert(RegisterLazyFunction("with", 2, func(args []Expression, ctx Context) (float64, error) {
+		name, ok := ReferenceName(args[0])
+		if ok == false {
+			return 0, fmt.Errorf("expected a variable, got %s", args[0])
+		}
+		return args[1].Eval(&withContext{Context: ctx, name: name, value: 2})
+	}), IsNil)
+	defer UnregisterFunction("with")
+
+	ctx := NewMapContext()
+	c.Assert(ctx.CompileAndAdd("loop", "with(t, loop + t)"), IsNil)
+	c.Assert(ctx.CompileAndAdd("double", "with(t, t * base)"), IsNil)
+	c.Assert(ctx.CompileAndAdd("base", "with(u, u + 1)"), IsNil)
+
+	e, err := Compile("loop")
+	c.Assert(err, IsNil)
+	_, err = e.Eval(ctx)
+	c.Check(err, ErrorMatches, "in loop -> loop: Got cyclic dependency loop -> loop")
+
+	e, err = Compile("double")
+	c.Assert(err, IsNil)
+	res, err := e.Eval(ctx)
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, 6.0)
 }
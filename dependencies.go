@@ -0,0 +1,113 @@
+package meval
+
+import "sort"
+
+// Dependencies returns the sorted list of variables directly
+// referenced by e.
+//
+// Variables bound by a LazyEvaluer, like the 'i' in 'sum(i, 1, 10,
+// i^2)', cannot be distinguished from other references, and are
+// therefore reported.
+func Dependencies(e Expression) []string {
+	found := make(map[string]bool)
+	collectDependencies(e, found)
+	return sortedKeys(found)
+}
+
+// TransitiveDependencies returns the sorted list of variables
+// referenced by e, directly or through the Expression defined in c
+// for these variables. Variables that c does not define are reported
+// as well, but their own dependencies obviously cannot be
+// looked up. c can be nil, then only the direct dependencies are
+// reported.
+func TransitiveDependencies(e Expression, c Context) []string {
+	found := make(map[string]bool)
+	collectDependencies(e, found)
+	if c == nil {
+		return sortedKeys(found)
+	}
+
+	toVisit := sortedKeys(found)
+	visited := make(map[string]bool)
+	for len(toVisit) > 0 {
+		name := toVisit[len(toVisit)-1]
+		toVisit = toVisit[:len(toVisit)-1]
+		if visited[name] == true {
+			continue
+		}
+		visited[name] = true
+
+		expr, err := c.GetExpression(name)
+		if err != nil {
+			continue
+		}
+		deps := make(map[string]bool)
+		collectDependencies(expr, deps)
+		for d := range deps {
+			found[d] = true
+			if visited[d] == false {
+				toVisit = append(toVisit, d)
+			}
+		}
+	}
+	return sortedKeys(found)
+}
+
+func collectDependencies(e Expression, found map[string]bool) {
+	Inspect(e, func(e Expression) bool {
+		if ref, ok := e.(ReferenceNode); ok == true {
+			found[ref.Variable()] = true
+		}
+		return true
+	})
+}
+
+func sortedKeys(m map[string]bool) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// IsDeterministic returns true if e always evaluates to the same
+// value, i.e. if it does not call any function or operator registered
+// with the Impure option, like rand(). Variables referenced by e are
+// followed through c, that can be nil, so e is only deterministic if
+// all the variables defined in c it depends on are deterministic.
+// Variables that c does not define are assumed to be deterministic.
+func IsDeterministic(e Expression, c Context) bool {
+	if isPure(e) == false {
+		return false
+	}
+	if c == nil {
+		return true
+	}
+	for _, name := range TransitiveDependencies(e, c) {
+		if expr, err := c.GetExpression(name); err == nil && isPure(expr) == false {
+			return false
+		}
+	}
+	return true
+}
+
+// isPure returns true if e does not call any impure function. The
+// variables referenced by e are not followed.
+func isPure(e Expression) bool {
+	res := true
+	Inspect(e, func(e Expression) bool {
+		switch n := e.(type) {
+		case *unaryExp:
+			res = res && n.impure == false
+		case *binaryExp:
+			res = res && n.impure == false
+		case *nExp:
+			res = res && n.impure == false
+		case *lazyExp:
+			res = res && n.impure == false
+		}
+		return res
+	})
+	return res
+}
@@ -0,0 +1,134 @@
+package meval
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type DependenciesSuite struct {
+	c *MapContext
+}
+
+var _ = Suite(&DependenciesSuite{
+	c: NewMapContext(),
+})
+
+func (s *DependenciesSuite) SetUpSuite(c *C) {
+	defs := map[string]string{
+		"speed":     "distance / time",
+		"distance":  "2 * radius * pi()",
+		"radius":    "3.0",
+		"time":      "max(offset, 1)",
+		"loop":      "1 + loop2",
+		"loop2":     "loop * 2",
+		"max_speed": "speed * factor",
+		"noise":     "rand() * 0.1",
+		"measure":   "speed + noise",
+	}
+	for name, input := range defs {
+		err := s.c.CompileAndAdd(name, input)
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *DependenciesSuite) TestDirectDependencies(c *C) {
+	tests := []struct {
+		input string
+		deps  []string
+	}{
+		{"1 + 2", []string{}},
+		{"speed > max_speed", []string{"max_speed", "speed"}},
+		{"a * (b + a) - if(c, sin(d), -a)", []string{"a", "b", "c", "d"}},
+	}
+	for _, t := range tests {
+		e, err := Compile(t.input)
+		c.Assert(err, IsNil)
+		c.Check(Dependencies(e), DeepEquals, t.deps, Commentf("input: %s", t.input))
+		c.Check(TransitiveDependencies(e, nil), DeepEquals, t.deps, Commentf("input: %s", t.input))
+	}
+}
+
+func (s *DependenciesSuite) TestTransitiveDependencies(c *C) {
+	tests := []struct {
+		input string
+		deps  []string
+	}{
+		{"speed", []string{"distance", "offset", "radius", "speed", "time"}},
+		{"speed > max_speed", []string{"distance", "factor", "max_speed", "offset", "radius", "speed", "time"}},
+		// cycles does not matter
+		{"loop", []string{"loop", "loop2"}},
+	}
+	for _, t := range tests {
+		e, err := Compile(t.input)
+		c.Assert(err, IsNil)
+		c.Check(TransitiveDependencies(e, s.c), DeepEquals, t.deps, Commentf("input: %s", t.input))
+	}
+}
+
+func (s *DependenciesSuite) TestIsDeterministic(c *C) {
+	c.Assert(RegisterLazyFunction("pick", 2, func(args []Expression, ctx Context) (float64, error) {
+		return args[1].Eval(ctx)
+	}, Impure), IsNil)
+	defer UnregisterFunction("pick")
+	c.Check(LookupFunction("pick"), DeepEquals, []FunctionInfo{{Name: "pick", MinArgs: 2, MaxArgs: 2, Lazy: true, Impure: true}})
+	c.Check(LookupFunction("rand"), DeepEquals, []FunctionInfo{{Name: "rand", MinArgs: 0, MaxArgs: 0, Impure: true}})
+	c.Check(LookupFunction("sin")[0].Impure, Equals, false)
+
+	tests := []struct {
+		input              string
+		direct, transitive bool
+	}{
+		{"1 + sin(pi())", true, true},
+		{"2 * rand()", false, false},
+		{"if(1, 2, max(3, rand()))", false, false},
+		{"pick(1, 2)", false, false},
+		{"speed > max_speed", true, true},
+		{"measure * 2", true, false},
+		{"undefined + 1", true, true},
+		{"loop", true, true},
+	}
+	for _, t := range tests {
+		e, err := Compile(t.input)
+		c.Assert(err, IsNil)
+		c.Check(IsDeterministic(e, nil), Equals, t.direct, Commentf("input: %s", t.input))
+		c.Check(IsDeterministic(e, s.c), Equals, t.transitive, Commentf("input: %s", t.input))
+	}
+}
+
+func (s *DependenciesSuite) TestImpureOperators(c *C) {
+	l := NewLanguage()
+	calls := 0
+	counter := func(a []float64) float64 {
+		calls++
+		return float64(calls)
+	}
+	c.Assert(l.RegisterOperator("?", 2, true, counter, Impure), IsNil)
+	c.Assert(l.RegisterPrefixOperator("?", 5, counter, Impure), IsNil)
+	c.Check(l.RegisterOperator("?!", 2, true, counter, Derivatives("1", "1")), ErrorMatches,
+		"Operator '\\?!' cannot have partial derivatives")
+	info, ok := l.LookupOperator("?")
+	c.Check(ok, Equals, true)
+	c.Check(info.Impure, Equals, true)
+
+	ref, err := Compile("a - a")
+	c.Assert(err, IsNil)
+	for _, input := range []string{"1 ? 2", "?1"} {
+		e, err := l.Compile(input)
+		c.Assert(err, IsNil)
+		c.Check(IsDeterministic(e, nil), Equals, false, Commentf("input: %s", input))
+		_, folded := Simplify(e).(*valueExp)
+		c.Check(folded, Equals, false, Commentf("input: %s", input))
+
+		// the operator is evaluated at each reference
+		cached := NewCachedContext()
+		cached.Add("a", e)
+		res, err := ref.Eval(cached)
+		c.Assert(err, IsNil)
+		c.Check(res, Not(Equals), 0.0, Commentf("input: %s", input))
+
+		p, err := NewProgram(ref, cached)
+		c.Assert(err, IsNil)
+		res, err = p.Eval(nil)
+		c.Assert(err, IsNil)
+		c.Check(res, Not(Equals), 0.0, Commentf("input: %s", input))
+	}
+}
@@ -0,0 +1,322 @@
+package meval
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Derive returns the derivative of e with respect to variable. Other
+// variables are considered as constants, the Expression they may be
+// bound to in a Context are not followed.
+//
+// The built-in operators and functions can be differentiated, as
+// well as the functions registered with the Derivatives option. The
+// comparison and logical operators are differentiated as piecewise
+// constant functions. Any other call fails with a *DerivativeError.
+//
+// The result is simplified with Simplify. Terms that are known to be
+// null are dropped, even if they would evaluate to NaN.
+func Derive(e Expression, variable string) (Expression, error) {
+	res, err := derive(e, variable)
+	if err != nil {
+		return nil, err
+	}
+	return Simplify(res), nil
+}
+
+// deriver differentiates a call, given the derivatives of its
+// arguments.
+type deriver func(call *nExp, dargs []Expression) (Expression, error)
+
+// derivedBy sets the deriver of a built-in function
+func derivedBy(d deriver) FunctionOption {
+	return func(f *function) {
+		f.derive = d
+	}
+}
+
+// Derivatives gives the partial derivatives of a function with
+// respect to each of its arguments, so Derive can differentiate its
+// calls. Each partial derivative is an expression of the arguments,
+// named x1, x2, ..., like Derivatives("cos(x1)") for sin(). They are
+// compiled by the Language the function is registered in, the
+// registration fails if they are invalid. Variadic functions cannot
+// have partial derivatives.
+func Derivatives(exprs ...string) FunctionOption {
+	return func(f *function) {
+		f.partials = &partials{sources: exprs}
+	}
+}
+
+// partials are the partial derivatives of a function
+type partials struct {
+	sources []string
+	// symbols used to compile sources, the built-in ones if nil
+	symbols *symbols
+
+	once  sync.Once
+	exprs []Expression
+	err   error
+}
+
+func (p *partials) compile() ([]Expression, error) {
+	p.once.Do(func() {
+		s := p.symbols
+		if s == nil {
+			s = builtins
+		}
+		for _, source := range p.sources {
+			e, err := buildAST(source, s)
+			if err != nil {
+				p.err = fmt.Errorf("Invalid partial derivative %q: %s", source, err)
+				return
+			}
+			p.exprs = append(p.exprs, e)
+		}
+	})
+	return p.exprs, p.err
+}
+
+// derive applies the chain rule
+func (p *partials) derive(call *nExp, dargs []Expression) (Expression, error) {
+	exprs, err := p.compile()
+	if err != nil {
+		return nil, err
+	}
+	var res Expression = zero()
+	for i, d := range dargs {
+		if isValue(d, 0) == true {
+			continue
+		}
+		res = add(res, mul(substituteArguments(exprs[i], call.children), d))
+	}
+	return res, nil
+}
+
+// substituteArguments replaces the references to x1, x2, ... in e by
+// args
+func substituteArguments(e Expression, args []Expression) Expression {
+	return Rewrite(e, func(e Expression) Expression {
+		name, ok := ReferenceName(e)
+		if ok == false || strings.HasPrefix(name, "x") == false {
+			return e
+		}
+		i, err := strconv.Atoi(name[1:])
+		if err != nil || i < 1 || i > len(args) {
+			return e
+		}
+		return args[i-1]
+	})
+}
+
+func deriveSum(call *nExp, dargs []Expression) (Expression, error) {
+	var res Expression = zero()
+	for _, d := range dargs {
+		res = add(res, d)
+	}
+	return res, nil
+}
+
+// deriveExtremum differentiates min() and max(), as the derivative
+// of the first argument equal to the result.
+func deriveExtremum(call *nExp, dargs []Expression) (Expression, error) {
+	res := dargs[len(dargs)-1]
+	for i := len(dargs) - 2; i >= 0; i-- {
+		res = builtinCall("if", builtinBinary("==", call.children[i], call), dargs[i], res)
+	}
+	return res, nil
+}
+
+func derive(e Expression, variable string) (Expression, error) {
+	switch n := e.(type) {
+	case *valueExp:
+		return zero(), nil
+	case *refExp:
+		if n.variable == variable {
+			return one(), nil
+		}
+		return zero(), nil
+	case *cachedExp:
+		return derive(n.expr, variable)
+	case *unaryExp:
+		if n.builtin == false {
+			return nil, &DerivativeError{Name: n.name}
+		}
+		d, err := derive(n.child, variable)
+		if err != nil {
+			return nil, err
+		}
+		switch n.name {
+		case "+":
+			return d, nil
+		case "-":
+			return neg(d), nil
+		}
+		return zero(), nil
+	case *binaryExp:
+		if n.builtin == false {
+			return nil, &DerivativeError{Name: n.name}
+		}
+		return deriveBinary(n, variable)
+	case *lazyBinaryExp:
+		if n.builtin == false {
+			return nil, &DerivativeError{Name: n.name}
+		}
+		return zero(), nil
+	case *lazyExp:
+		if n.builtin == false || n.name != "if" {
+			return nil, &DerivativeError{Name: n.name + "()"}
+		}
+		dthen, err := derive(n.children[1], variable)
+		if err != nil {
+			return nil, err
+		}
+		delse, err := derive(n.children[2], variable)
+		if err != nil {
+			return nil, err
+		}
+		return builtinCall("if", n.children[0], dthen, delse), nil
+	case *nExp:
+		dargs := make([]Expression, len(n.children))
+		constant := true
+		for i, c := range n.children {
+			var err error
+			if dargs[i], err = derive(c, variable); err != nil {
+				return nil, err
+			}
+			constant = constant && isValue(dargs[i], 0)
+		}
+		if n.impure == true || (n.derive == nil && constant == false) {
+			return nil, &DerivativeError{Name: n.name + "()"}
+		}
+		if constant == true {
+			return zero(), nil
+		}
+		return n.derive(n, dargs)
+	}
+	return nil, &DerivativeError{Name: format(e)}
+}
+
+func deriveBinary(e *binaryExp, variable string) (Expression, error) {
+	a, b := e.leftChild, e.rightChild
+	da, err := derive(a, variable)
+	if err != nil {
+		return nil, err
+	}
+	db, err := derive(b, variable)
+	if err != nil {
+		return nil, err
+	}
+	switch e.name {
+	case "+":
+		return add(da, db), nil
+	case "-":
+		return sub(da, db), nil
+	case "*":
+		return add(mul(da, b), mul(a, db)), nil
+	case "/":
+		if isValue(db, 0) == true {
+			return div(da, b), nil
+		}
+		return div(sub(mul(da, b), mul(a, db)), builtinBinary("^", b, &valueExp{value: 2.0})), nil
+	case "^":
+		if isValue(b, 1) == true {
+			return da, nil
+		}
+		if isValue(db, 0) == true {
+			return mul(mul(b, builtinBinary("^", a, sub(b, one()))), da), nil
+		}
+		if isValue(da, 0) == true {
+			return mul(mul(e, builtinCall("ln", a)), db), nil
+		}
+		return mul(e, add(mul(db, builtinCall("ln", a)), div(mul(b, da), a))), nil
+	}
+	// comparisons are piecewise constant
+	return zero(), nil
+}
+
+func zero() Expression {
+	return &valueExp{value: 0.0}
+}
+
+func one() Expression {
+	return &valueExp{value: 1.0}
+}
+
+// add, sub, mul, div and neg builds the built-in operations, dropping
+// null terms.
+
+func add(a, b Expression) Expression {
+	if isValue(a, 0) == true {
+		return b
+	}
+	if isValue(b, 0) == true {
+		return a
+	}
+	return builtinBinary("+", a, b)
+}
+
+func sub(a, b Expression) Expression {
+	if isValue(b, 0) == true {
+		return a
+	}
+	if isValue(a, 0) == true {
+		return neg(b)
+	}
+	return builtinBinary("-", a, b)
+}
+
+func mul(a, b Expression) Expression {
+	if isValue(a, 0) == true || isValue(b, 0) == true {
+		return zero()
+	}
+	if isValue(a, 1) == true {
+		return b
+	}
+	if isValue(b, 1) == true {
+		return a
+	}
+	return builtinBinary("*", a, b)
+}
+
+func div(a, b Expression) Expression {
+	if isValue(a, 0) == true {
+		return zero()
+	}
+	if isValue(b, 1) == true {
+		return a
+	}
+	return builtinBinary("/", a, b)
+}
+
+func neg(a Expression) Expression {
+	if isValue(a, 0) == true {
+		return zero()
+	}
+	out := outQueue{}
+	out.push(a)
+	return builtins.prefixOperators[TokMinus].poper(&out)
+}
+
+// builtinBinary returns the built-in binary operation name
+func builtinBinary(name string, left, right Expression) Expression {
+	out := outQueue{}
+	out.push(left)
+	out.push(right)
+	return builtins.operators[builtins.tokens[name]].poper(&out)
+}
+
+// builtinCall returns a call to the built-in function name
+func builtinCall(name string, args ...Expression) Expression {
+	f, err := resolveFunction(name, builtins.functions[name], len(args))
+	if err != nil {
+		panic("Should never happen: " + err.Error())
+	}
+	out := outQueue{}
+	for _, a := range args {
+		out.push(a)
+	}
+	return f.poper(len(args))(&out)
+}
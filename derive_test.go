@@ -0,0 +1,132 @@
+package meval
+
+import (
+	"errors"
+	"math"
+
+	. "gopkg.in/check.v1"
+)
+
+type DeriveSuite struct{}
+
+var _ = Suite(&DeriveSuite{})
+
+func (s *DeriveSuite) TestDerive(c *C) {
+	tests := []struct {
+		input, output string
+	}{
+		{"3", "0"},
+		{"x", "1"},
+		{"y", "0"},
+		{"2 * x + y", "2"},
+		{"x * y - x", "y - 1"},
+		{"x ^ 3", "3 * x ^ 2"},
+		{"x ^ 2", "2 * x"},
+		{"x ^ 1", "1"},
+		{"2 ^ x", "2 ^ x * 0.6931471805599453"},
+		{"x ^ x", "x ^ x * (ln(x) + x / x)"},
+		{"1 / x", "-1 / x ^ 2"},
+		{"x / 2", "0.5"},
+		{"sin(2 * x)", "cos(2 * x) * 2"},
+		{"cos(x)", "-sin(x)"},
+		{"exp(x ^ 2)", "exp(x ^ 2) * (2 * x)"},
+		{"ln(x)", "1 / x"},
+		{"sqrt(x)", "1 / (2 * sqrt(x))"},
+		{"atan2(x, y)", "y / (x ^ 2 + y ^ 2)"},
+		{"-x + pi()", "-1"},
+		{"sum(x, 2 * x, y)", "3"},
+		{"max(x, y)", "if(x == max(x, y), 1, 0)"},
+		{"if(x > 0, x ^ 2, -x)", "if(x > 0, 2 * x, -1)"},
+		{"(x > 0) * x", "x > 0"},
+		{"sin(y) * x", "sin(y)"},
+		{"floor(x)", "0"},
+	}
+	for _, t := range tests {
+		e, err := Compile(t.input)
+		c.Assert(err, IsNil)
+		d, err := Derive(e, "x")
+		if c.Check(err, IsNil, Commentf("input: %s", t.input)) == false {
+			continue
+		}
+		c.Check(format(d), Equals, t.output, Commentf("input: %s", t.input))
+	}
+}
+
+func (s *DeriveSuite) TestDerivativesMatchFiniteDifferences(c *C) {
+	inputs := []string{
+		"tan(x) + asin(x / 2) + acos(x / 3) + atan(x)",
+		"log(x) * ln(x ^ 2)",
+		"x ^ sin(x)",
+		"atan2(x, 2 * x + 1) + atan2(1, x)",
+		"(x ^ 2 + 1) / (x - 3)",
+		"min(x, 1) + max(2 * x, 0.5)",
+	}
+	const h = 1e-6
+	ctx := NewMapContext()
+	for _, input := range inputs {
+		e, err := Compile(input)
+		c.Assert(err, IsNil)
+		d, err := Derive(e, "x")
+		c.Assert(err, IsNil, Commentf("input: %s", input))
+		for _, x := range []float64{0.3, 0.7, 1.2} {
+			ctx.Add("x", NewValue(x+h))
+			after, err := e.Eval(ctx)
+			c.Assert(err, IsNil)
+			ctx.Add("x", NewValue(x-h))
+			before, err := e.Eval(ctx)
+			c.Assert(err, IsNil)
+			ctx.Add("x", NewValue(x))
+			res, err := d.Eval(ctx)
+			c.Assert(err, IsNil)
+			c.Check(math.Abs(res-(after-before)/(2*h)) < 1e-5, Equals, true,
+				Commentf("%s at %g: got %g, expected %g", input, x, res, (after-before)/(2*h)))
+		}
+	}
+}
+
+func (s *DeriveSuite) TestUserDerivatives(c *C) {
+	c.Assert(RegisterFunction("square", 1, func(a []float64) float64 { return a[0] * a[0] }, Derivatives("2 * x1")), IsNil)
+	defer UnregisterFunction("square")
+	c.Assert(RegisterFunction("hypot", 2, func(a []float64) float64 { return math.Hypot(a[0], a[1]) },
+		Derivatives("x1 / hypot(x1, x2)", "x2 / hypot(x1, x2)")), IsNil)
+	defer UnregisterFunction("hypot")
+	c.Assert(RegisterFunction("opaque", 1, func(a []float64) float64 { return a[0] }), IsNil)
+	defer UnregisterFunction("opaque")
+
+	e, err := Compile("square(x * y) + hypot(x, 1)")
+	c.Assert(err, IsNil)
+	d, err := Derive(e, "x")
+	c.Assert(err, IsNil)
+	c.Check(format(d), Equals, "2 * (x * y) * y + x / hypot(x, 1)")
+
+	err = RegisterFunction("bad", 1, func(a []float64) float64 { return 0 }, Derivatives("2 *"))
+	c.Check(err, ErrorMatches, "Invalid partial derivative \"2 \\*\": 1:4: Unexpected end of input")
+	c.Check(LookupFunction("bad"), IsNil)
+	err = RegisterFunction("bad", 2, func(a []float64) float64 { return 0 }, Derivatives("1"))
+	c.Check(err, ErrorMatches, "'bad\\(\\)' expects 2 partial derivatives, got 1")
+
+	tests := []struct {
+		input, name string
+	}{
+		{"opaque(x)", "opaque()"},
+		{"rand() * x", "rand()"},
+		{"if(x, opaque(x), 1)", "opaque()"},
+	}
+	for _, t := range tests {
+		e, err := Compile(t.input)
+		c.Assert(err, IsNil)
+		_, err = Derive(e, "x")
+		var derr *DerivativeError
+		if c.Check(errors.As(err, &derr), Equals, true, Commentf("input: %s", t.input)) == true {
+			c.Check(derr.Name, Equals, t.name)
+			c.Check(err, ErrorMatches, "Cannot differentiate '.*'")
+		}
+	}
+
+	// calls with constant arguments are constant
+	e, err = Compile("opaque(y) * x")
+	c.Assert(err, IsNil)
+	d, err = Derive(e, "x")
+	c.Assert(err, IsNil)
+	c.Check(format(d), Equals, "opaque(y)")
+}
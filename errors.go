@@ -0,0 +1,314 @@
+package meval
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A Position locates a portion of an input string.
+type Position struct {
+	// Offset is the byte offset of the start of the portion, starting
+	// at 0.
+	Offset int
+	// Line is the line number, starting at 1.
+	Line int
+	// Column is the rune column in the line, starting at 1.
+	Column int
+	// Length is the length in bytes of the portion.
+	Length int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// Highlight returns the line of input containing p, with a line of
+// carets underneath the portion designated by p.
+func (p Position) Highlight(input string) string {
+	if p.Offset > len(input) {
+		p.Offset = len(input)
+	}
+	lineStart := strings.LastIndex(input[:p.Offset], "\n") + 1
+	lineEnd := strings.Index(input[p.Offset:], "\n")
+	if lineEnd < 0 {
+		lineEnd = len(input)
+	} else {
+		lineEnd += p.Offset
+	}
+
+	// we keep tabulations, so the carets are aligned
+	marker := make([]rune, 0, p.Offset-lineStart)
+	for _, ru := range input[lineStart:p.Offset] {
+		if ru == '\t' {
+			marker = append(marker, '\t')
+		} else {
+			marker = append(marker, ' ')
+		}
+	}
+
+	end := p.Offset + p.Length
+	if end > lineEnd {
+		end = lineEnd
+	}
+	width := utf8.RuneCountInString(input[p.Offset:end])
+	if width == 0 {
+		width = 1
+	}
+
+	return input[lineStart:lineEnd] + "\n" + string(marker) + strings.Repeat("^", width)
+}
+
+// advance returns the Position just after the text, if text starts
+// at p.
+func (p Position) advance(text string) Position {
+	res := Position{
+		Offset: p.Offset + len(text),
+		Line:   p.Line,
+		Column: p.Column,
+	}
+	for _, ru := range text {
+		if ru == '\n' {
+			res.Line++
+			res.Column = 1
+		} else {
+			res.Column++
+		}
+	}
+	return res
+}
+
+// positionAt returns the Position of offset in input
+func positionAt(input string, offset, length int) Position {
+	res := Position{Line: 1, Column: 1}.advance(input[:offset])
+	res.Length = length
+	return res
+}
+
+// A ParseError is returned by the Lexer and by Compile when the input
+// cannot be parsed. It reports the position of the failure in the
+// input.
+type ParseError struct {
+	// Input is the whole parsed string
+	Input string
+	// Pos is the location of the failure in Input
+	Pos Position
+	// Err is the underlying error
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Highlight returns the faulty line of the input, with carets
+// underneath the location of the error.
+func (e *ParseError) Highlight() string {
+	return e.Pos.Highlight(e.Input)
+}
+
+func newParseError(input string, pos Position, err error) error {
+	return &ParseError{
+		Input: input,
+		Pos:   pos,
+		Err:   err,
+	}
+}
+
+func newSyntaxError(input string, pos Position, format string, args ...interface{}) error {
+	return newParseError(input, pos, &SyntaxError{Msg: fmt.Sprintf(format, args...)})
+}
+
+// A SyntaxError reports a malformed input. It is always wrapped in a
+// ParseError.
+type SyntaxError struct {
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return e.Msg
+}
+
+// An ArityError reports an operator or a function that does not
+// receive the number of arguments it expects.
+type ArityError struct {
+	// Name of the operator or function
+	Name string
+	// Min and Max are the bounds of the accepted number of
+	// arguments. A negative Max means there is no upper bound.
+	Min, Max int
+	// Accepted lists the disjoint ranges of accepted number of
+	// arguments of an overloaded function, as {min, max} pairs. It is
+	// nil if all the numbers between Min and Max are accepted.
+	Accepted [][2]int
+	// Got is the number of provided arguments
+	Got int
+}
+
+func (e *ArityError) Error() string {
+	if len(e.Accepted) > 1 {
+		ranges := make([]string, len(e.Accepted))
+		for i, r := range e.Accepted {
+			switch {
+			case r[0] == r[1]:
+				ranges[i] = strconv.Itoa(r[0])
+			case r[1] < 0:
+				ranges[i] = fmt.Sprintf("at least %d", r[0])
+			default:
+				ranges[i] = fmt.Sprintf("%d to %d", r[0], r[1])
+			}
+		}
+		last := len(ranges) - 1
+		return fmt.Sprintf("'%s' expects %s or %s arguments, got %d",
+			e.Name, strings.Join(ranges[:last], ", "), ranges[last], e.Got)
+	}
+	switch {
+	case e.Min == e.Max:
+		return fmt.Sprintf("'%s' expects %d %s, got %d", e.Name, e.Min, arguments(e.Min), e.Got)
+	case e.Max < 0:
+		return fmt.Sprintf("'%s' expects at least %d %s, got %d", e.Name, e.Min, arguments(e.Min), e.Got)
+	}
+	return fmt.Sprintf("'%s' expects between %d and %d arguments, got %d", e.Name, e.Min, e.Max, e.Got)
+}
+
+func arguments(n int) string {
+	if n == 1 {
+		return "argument"
+	}
+	return "arguments"
+}
+
+// An UndefinedVariableError is returned when a Context does not
+// define a referenced variable.
+type UndefinedVariableError struct {
+	// Name of the variable
+	Name string
+	// Context is the name of the Context type that reported the
+	// error
+	Context string
+}
+
+func (e *UndefinedVariableError) Error() string {
+	return fmt.Sprintf("Could not find '%s' in %s", e.Name, e.Context)
+}
+
+// A NoContextError is returned when an Expression that refers a
+// variable is evaluated with a nil Context.
+type NoContextError struct {
+	// Name of the referenced variable
+	Name string
+}
+
+func (e *NoContextError) Error() string {
+	return fmt.Sprintf("'%s' referenced, but no Context providen", e.Name)
+}
+
+// A CyclicDependencyError is returned when a variable depends on
+// itself.
+type CyclicDependencyError struct {
+	// Cycle is the list of variables forming the cycle. First and
+	// last elements are the same.
+	Cycle []string
+}
+
+func (e *CyclicDependencyError) Error() string {
+	return "Got cyclic dependency " + strings.Join(e.Cycle, " -> ")
+}
+
+// A FunctionError is returned when a registered function or operator
+// fails, or panics, during the evaluation.
+type FunctionError struct {
+	// Name of the function or operator
+	Name string
+	// Err is the error returned by the function
+	Err error
+}
+
+func (e *FunctionError) Error() string {
+	return fmt.Sprintf("Error in '%s': %s", e.Name, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *FunctionError) Unwrap() error {
+	return e.Err
+}
+
+// An EvalError is returned when the evaluation of a referenced
+// variable failed. It preserves the chain of variables that leads to
+// the failure.
+type EvalError struct {
+	// Chain is the list of references followed from the evaluated
+	// Expression to the failing one.
+	Chain []string
+	// Err is the underlying error
+	Err error
+}
+
+func (e *EvalError) Error() string {
+	return fmt.Sprintf("in %s: %s", strings.Join(e.Chain, " -> "), e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *EvalError) Unwrap() error {
+	return e.Err
+}
+
+// wrapEvalError prepends variable to the chain of err, wrapping it
+// in an EvalError if needed
+func wrapEvalError(variable string, err error) error {
+	if eerr, ok := err.(*EvalError); ok == true {
+		return &EvalError{
+			Chain: append([]string{variable}, eerr.Chain...),
+			Err:   eerr.Err,
+		}
+	}
+	return &EvalError{
+		Chain: []string{variable},
+		Err:   err,
+	}
+}
+
+// ConflictError is returned when registering a function or an
+// operator whose name is already taken.
+type ConflictError struct {
+	// "function", "operator" or "prefix operator"
+	Kind string
+	Name string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("Already registered %s '%s'", e.Kind, e.Name)
+}
+
+// A DerivativeError is returned by Derive and EvalGradient when an
+// Expression calls a function or an operator that cannot be
+// differentiated.
+type DerivativeError struct {
+	// Name of the function or operator
+	Name string
+}
+
+func (e *DerivativeError) Error() string {
+	return fmt.Sprintf("Cannot differentiate '%s'", e.Name)
+}
+
+// A RowError reports the row of a batch evaluation that failed, see
+// EvalBatch.
+type RowError struct {
+	Row int
+	Err error
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("row %d: %s", e.Row, e.Err)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
@@ -3,7 +3,6 @@ package meval
 import (
 	"fmt"
 	"math"
-	"strings"
 )
 
 // Expression can be evaluated to float from a Context
@@ -16,9 +15,10 @@ type Expression interface {
 	Eval(Context) (float64, error)
 }
 
-// Compile a new expression from an input string
+// Compile a new expression from an input string, using the default
+// Language.
 func Compile(input string) (Expression, error) {
-	return buildAST(input)
+	return defaultLanguage.Compile(input)
 }
 
 //rest of the stuff is pretty private
@@ -26,26 +26,40 @@ type refExp struct {
 	variable string
 }
 
-// TODO: This should be resilient to cyclic call ... this is not the
-// case right now
+// Cyclic dependencies are detected using the call stack of the
+// evaluation, carried by the Context passed to children.
 func (e *refExp) Eval(c Context) (float64, error) {
 	if c == nil {
-		return math.NaN(), fmt.Errorf("'%s' referenced, but no Context providen",
-			e.variable)
+		return math.NaN(), &NoContextError{Name: e.variable}
 	}
 
-	if bad, deps := c.testStack(e); bad == true {
+	f := frameOf(c)
+	if bad, deps := f.stack.testStack(e); bad == true {
 		deps = append([]string{deps[len(deps)-1]},
 			deps...)
-		return math.NaN(), fmt.Errorf("Got cyclic dependency %s", strings.Join(deps, " -> "))
+		return math.NaN(), &CyclicDependencyError{Cycle: deps}
 	}
-	c.push(e)
-	defer c.pop()
-	expr, err := c.GetExpression(e.variable)
+	f.stack.push(e)
+	defer f.stack.pop()
+	expr, err := f.GetExpression(e.variable)
 	if err != nil {
 		return math.NaN(), err
 	}
-	return expr.Eval(c)
+	res, err := expr.Eval(f)
+	if err != nil {
+		return math.NaN(), wrapEvalError(e.variable, err)
+	}
+	return res, nil
+}
+
+// ReferenceName returns the name of the referenced variable if e is
+// a plain reference to a variable, like the 'i' in 'sum(i, 1, 10,
+// i^2)'.
+func ReferenceName(e Expression) (string, bool) {
+	if ref, ok := e.(ReferenceNode); ok == true {
+		return ref.Variable(), true
+	}
+	return "", false
 }
 
 type valueExp struct {
@@ -56,11 +70,37 @@ func (e *valueExp) Eval(Context) (float64, error) {
 	return e.value, nil
 }
 
-type binaryEvaluer func(float64, float64) float64
+type unaryEvaluer func(float64) (float64, error)
+
+type unaryExp struct {
+	name       string
+	precedence int
+	child      Expression
+	evaluer    unaryEvaluer
+	// true for built-in operators
+	builtin bool
+	// true for operators registered with the Impure option
+	impure bool
+}
+
+func (e *unaryExp) Eval(c Context) (float64, error) {
+	value, err := e.child.Eval(c)
+	if err != nil {
+		return math.NaN(), err
+	}
+	return e.evaluer(value)
+}
+
+type binaryEvaluer func(float64, float64) (float64, error)
 
 type binaryExp struct {
+	name                  string
+	precedence            int
+	leftAssociative       bool
 	leftChild, rightChild Expression
 	evaluer               binaryEvaluer
+	builtin               bool
+	impure                bool
 }
 
 func (e *binaryExp) Eval(c Context) (float64, error) {
@@ -73,17 +113,27 @@ func (e *binaryExp) Eval(c Context) (float64, error) {
 	if err != nil {
 		return math.NaN(), err
 	}
-	return e.evaluer(valueLeft, valueRight), nil
+	return e.evaluer(valueLeft, valueRight)
 }
 
 // NEvaluer is a function that takes a list of float and returns a
 // float
 type NEvaluer func([]float64) float64
 
+// FallibleEvaluer is a function that takes a list of float and
+// returns a float, or an error if the arguments are invalid.
+type FallibleEvaluer func([]float64) (float64, error)
+
 type nExp struct {
+	name     string
 	children []Expression
 	card     int
-	evaluer  NEvaluer
+	evaluer  FallibleEvaluer
+	// true if two calls with the same arguments may return
+	// different results
+	impure bool
+	// differentiates the call, nil if not differentiable
+	derive deriver
 }
 
 func (e *nExp) Eval(c Context) (float64, error) {
@@ -97,5 +147,71 @@ func (e *nExp) Eval(c Context) (float64, error) {
 			return math.NaN(), err
 		}
 	}
-	return e.evaluer(values), nil
+	return e.evaluer(values)
+}
+
+// protectEvaluer wraps a user provided evaluer, so its errors and
+// panics are reported as a FunctionError.
+func protectEvaluer(name string, evaluer FallibleEvaluer) FallibleEvaluer {
+	return func(args []float64) (res float64, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				res = math.NaN()
+				err = &FunctionError{Name: name, Err: fmt.Errorf("panic: %v", r)}
+			}
+		}()
+		res, err = evaluer(args)
+		if err != nil {
+			return math.NaN(), &FunctionError{Name: name, Err: err}
+		}
+		return res, nil
+	}
+}
+
+// protectLazyEvaluer wraps a user provided LazyEvaluer, so its panics
+// are reported as a FunctionError. As errors are most likely coming
+// from the evaluation of the arguments, they are left untouched.
+func protectLazyEvaluer(name string, evaluer LazyEvaluer) LazyEvaluer {
+	return func(args []Expression, c Context) (res float64, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				res = math.NaN()
+				err = &FunctionError{Name: name, Err: fmt.Errorf("panic: %v", r)}
+			}
+		}()
+		return evaluer(args, c)
+	}
+}
+
+// LazyEvaluer is a function that takes a list of unevaluated
+// Expression and the Context of the evaluation, and returns a
+// float. It is free to evaluate only some of the Expression, or to
+// evaluate them several times within another Context.
+type LazyEvaluer func([]Expression, Context) (float64, error)
+
+type lazyExp struct {
+	name     string
+	children []Expression
+	evaluer  LazyEvaluer
+	impure   bool
+	builtin  bool
+}
+
+func (e *lazyExp) Eval(c Context) (float64, error) {
+	return e.evaluer(bindArguments(e.children, frameOf(c).stack), c)
+}
+
+// lazyBinaryExp is a binary operator that receives its operands
+// unevaluated, like '&&'
+type lazyBinaryExp struct {
+	name                  string
+	precedence            int
+	leftAssociative       bool
+	leftChild, rightChild Expression
+	evaluer               LazyEvaluer
+	builtin               bool
+}
+
+func (e *lazyBinaryExp) Eval(c Context) (float64, error) {
+	return e.evaluer(bindArguments([]Expression{e.leftChild, e.rightChild}, frameOf(c).stack), c)
 }
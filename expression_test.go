@@ -1,8 +1,10 @@
 package meval
 
 import (
+	"errors"
 	"fmt"
 	"math"
+	"sync"
 
 	. "gopkg.in/check.v1"
 )
@@ -56,6 +58,19 @@ func (s *ExprSuite) TestBasicEval(c *C) {
 		{1.0, "floor(1.5)"},
 		{math.Pi / 4, "atan2(1.0,1.0)"},
 		{math.Pi / 4, "pi() / 4"},
+		{-1.0, "2-3"},
+		{2.0, "foo-1"},
+		{-3.0, "-foo"},
+		{-6.0, "2 * -foo"},
+		{-4.0, "-(1+3)"},
+		{-4.0, "-2^2"},
+		{-9.0, "-foo^2"},
+		{0.5, "2^-1"},
+		{-2.0, "-3 + 1"},
+		{3.0, "- -foo"},
+		{5.0, "  + 2 + 3"},
+		{-1.0, "-cos(0.0)"},
+		{-27.0, "-3 ^ 3 ^1"},
 	}
 
 	for i, e := range exps {
@@ -101,9 +116,42 @@ func (s *ExprSuite) TestCyclicEvaluationNotPermitted(c *C) {
 	c.Assert(err, IsNil, Commentf("Got compilation error %s", err))
 	res, err := exp.Eval(s.c)
 	c.Assert(err, Not(IsNil))
-	c.Check(err.Error(), Equals, "Got cyclic dependency bar -> baz -> foobar -> bar")
+	c.Check(err.Error(), Equals, "in bar -> baz -> foobar -> bar: Got cyclic dependency bar -> baz -> foobar -> bar")
 	c.Check(math.IsNaN(res), Equals, true)
 
+	var cerr *CyclicDependencyError
+	c.Assert(errors.As(err, &cerr), Equals, true)
+	c.Check(cerr.Cycle, DeepEquals, []string{"bar", "baz", "foobar", "bar"})
+
+}
+
+func (s *ExprSuite) TestEvalErrorTypes(c *C) {
+	s.c.CompileAndAdd("bar", "2 * baz")
+	s.c.CompileAndAdd("baz", "1 + does")
+	defer func() {
+		s.c.Delete("bar")
+		s.c.Delete("baz")
+	}()
+
+	exp, err := Compile("foo + bar")
+	c.Assert(err, IsNil)
+
+	_, err = exp.Eval(s.c)
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, "in bar -> baz: Could not find 'does' in MapContext")
+
+	var eerr *EvalError
+	c.Assert(errors.As(err, &eerr), Equals, true)
+	c.Check(eerr.Chain, DeepEquals, []string{"bar", "baz"})
+
+	var uerr *UndefinedVariableError
+	c.Assert(errors.As(err, &uerr), Equals, true)
+	c.Check(uerr.Name, Equals, "does")
+
+	_, err = exp.Eval(nil)
+	var nerr *NoContextError
+	c.Assert(errors.As(err, &nerr), Equals, true)
+	c.Check(nerr.Name, Equals, "foo")
 }
 
 type CompileError struct {
@@ -111,32 +159,62 @@ type CompileError struct {
 }
 
 func (s *ExprSuite) TestCompilationError(c *C) {
-	// this is for internal stuff
-	err := registerOpToken("%", TokPlus+100)
+	// '%' is known by the Lexer, but has no operator
+	lang := DefaultLanguage().Clone()
+	err := lang.RegisterOperator("%", 3, true, func(a []float64) float64 { return 0 })
 	c.Assert(err, IsNil)
+	c.Assert(lang.UnregisterOperator("%"), Equals, true)
 	tests := []CompileError{
-		{"( 2.0 ))", "Mismatched parenthese in ( 2.0 ))"},
-		{"(( foo )", "Mismatched parenthese in (( foo )"},
-		{"( +0x ))", "Bad number syntax \"+0x\""},
-		{"( +0x ))", "Bad number syntax \"+0x\""},
-		{"sin(0.0),", "Misplaced comma or mismatched parenthese in sin(0.0),"},
-		{"atan2(0.0 +,2.1)", "Evaluation stack error for '+', need 2 element, but only 1 provided"},
-		{"sin(0.0 , 0.3)", "Evaluation stack error, still got 2 element instead of 1 at the final state"},
-		{"5 % 3", "Operator '%' is not yet implemented"},
-		{"5 + ", "Evaluation stack error for '+', need 2 element, but only 1 provided"},
-		{"sin()", "Evaluation stack error for 'sin()', need 1 element, but only 0 provided"},
-		{"(5 + )", "Evaluation stack error for '+', need 2 element, but only 1 provided"},
-		{" * 3 + 2", "Evaluation stack error for '*', need 2 element, but only 1 provided"},
-		{"  + 2 + 3", "Evaluation stack error for '+', need 2 element, but only 1 provided"},
+		{"( 2.0 ))", "1:8: Mismatched parenthese in ( 2.0 ))"},
+		{"(( foo )", "1:1: Mismatched parenthese in (( foo )"},
+		{"( +0x ))", "1:3: Bad number syntax \"+0x\""},
+		{"( +0x ))", "1:3: Bad number syntax \"+0x\""},
+		{"sin(0.0),", "1:9: Misplaced comma or mismatched parenthese in sin(0.0),"},
+		{"atan2(0.0 +,2.1)", "1:12: Missing operand before ','"},
+		{"sin(0.0 , 0.3)", "1:1: 'sin()' expects 1 argument, got 2"},
+		{"5 % 3", "1:3: Operator '%' is not yet implemented"},
+		{"5 + ", "1:5: Unexpected end of input"},
+		{"sin()", "1:1: 'sin()' expects 1 argument, got 0"},
+		{"(5 + )", "1:6: Missing operand before ')'"},
+		{" * 3 + 2", "1:2: Missing operand before '*'"},
+		{"-", "1:2: Unexpected end of input"},
+		{"", "1:1: Unexpected end of input"},
+		{"1 + (2 * )", "1:10: Missing operand before ')'"},
+		{"atan2(1, )", "1:10: Missing operand before ')'"},
+		{"atan2(1, , 2)", "1:10: Missing operand before ','"},
+		{"(1, 2)", "1:3: Misplaced comma or mismatched parenthese in (1, 2)"},
+		{"2 * ()", "1:6: Missing operand before ')'"},
+		{"2 * pi", "1:5: Function 'pi()' called without parenthese"},
+		{"sin 2", "1:1: Function 'sin()' called without parenthese"},
+		{"max()", "1:1: 'max()' expects at least 1 argument, got 0"},
+		{"x y", "1:3: Missing operator before 'y'"},
+		{"2 3", "1:3: Missing operator before '3'"},
+		{"2 sin(1)", "1:3: Missing operator before 'sin'"},
+		{"(x)(y)", "1:4: Missing operator before '('"},
+		{"sin(1)(2)", "1:7: Missing operator before '('"},
+		{"1 + 2 (3)", "1:7: Missing operator before '('"},
 	}
 
 	for i, t := range tests {
-		_, err := Compile(t.input)
+		_, err := lang.Compile(t.input)
 		if c.Check(err, Not(IsNil)) == false {
 			continue
 		}
 		c.Check(err.Error(), Equals, t.error, Commentf("[%d] : %s]", i, t.input))
 	}
+
+	_, err = Compile("2 * (foo + 3")
+	c.Assert(err, Not(IsNil))
+	perr, ok := err.(*ParseError)
+	c.Assert(ok, Equals, true, Commentf("Compile should return a *ParseError"))
+	c.Check(perr.Highlight(), Equals, "2 * (foo + 3\n    ^")
+	var serr *SyntaxError
+	c.Check(errors.As(err, &serr), Equals, true)
+
+	_, err = Compile("2 * atan2(1)")
+	var aerr *ArityError
+	c.Assert(errors.As(err, &aerr), Equals, true)
+	c.Check(*aerr, DeepEquals, ArityError{Name: "atan2()", Min: 2, Max: 2, Got: 1})
 }
 
 func ExampleExpression_basic() {
@@ -202,21 +280,296 @@ func (s *ExprSuite) TestBug_BadStrconvError(c *C) {
 	for _, n := range badNumbers {
 		_, err := Compile(n)
 		c.Assert(err, Not(IsNil))
-		c.Check(err.Error(), Equals, "Internal Lexer error. Lexer gave us value "+n+", but strconv.Float64 cannot convert it : strconv.ParseFloat: parsing \""+n+"\": invalid syntax")
+		c.Check(err.Error(), Equals, "1:1: Internal Lexer error. Lexer gave us value "+n+", but strconv.Float64 cannot convert it : strconv.ParseFloat: parsing \""+n+"\": invalid syntax")
+	}
+}
+
+func (s *ExprSuite) TestComparisonOperators(c *C) {
+	exps := []ExpResult{
+		{1.0, "1 < 2"},
+		{0.0, "2 < 2"},
+		{1.0, "2 <= 2"},
+		{0.0, "3 <= 2"},
+		{1.0, "3 > 2"},
+		{0.0, "2 > 2"},
+		{1.0, "2 >= 2"},
+		{0.0, "1 >= 2"},
+		{1.0, "foo == 3"},
+		{0.0, "foo != 3"},
+		{1.0, "foo+1 > 2*foo-3"},
+		{0.0, "1-3<-2"},
+		{2.0, "(foo > 2) + (foo < 4)"},
+		{1.0, "1 < 2 == 1"},
+	}
+
+	for i, e := range exps {
+		ee, err := Compile(e.Input)
+		if c.Check(err, IsNil, Commentf("[%d: %s]: got error at compilation : %s", i, e, err)) == false {
+			continue
+		}
+		res, err := ee.Eval(s.c)
+		if c.Check(err, IsNil, Commentf("[%d: %s]: got error at evaluation: %s", i, e, err)) == false {
+			continue
+		}
+		c.Check(res, Equals, e.Result, Commentf("[%d: %s]", i, e))
+	}
+}
+
+func (s *ExprSuite) TestLogicalOperators(c *C) {
+	exps := []ExpResult{
+		{1.0, "1 && 2"},
+		{0.0, "1 && 0"},
+		{1.0, "0 || -1"},
+		{0.0, "0 || 0"},
+		{0.0, "!foo"},
+		{1.0, "!0"},
+		{1.0, "!!foo"},
+		{1.0, "foo > 2 && foo < 4"},
+		{1.0, "1 || 0 && 0"},
+		{0.0, "(1 || 0) && 0"},
+		{1.0, "!(foo == 2) && foo != 2"},
+		{3.0, "if(foo > 0, foo, -foo)"},
+		{-1.0, "if(foo < 0, 1, if(foo > 5, 2, -1))"},
+		{5.0, "2 + if(1, 3, 4)"},
+	}
+
+	for i, e := range exps {
+		ee, err := Compile(e.Input)
+		if c.Check(err, IsNil, Commentf("[%d: %s]: got error at compilation : %s", i, e, err)) == false {
+			continue
+		}
+		res, err := ee.Eval(s.c)
+		if c.Check(err, IsNil, Commentf("[%d: %s]: got error at evaluation: %s", i, e, err)) == false {
+			continue
+		}
+		c.Check(res, Equals, e.Result, Commentf("[%d: %s]", i, e))
+	}
+}
+
+func (s *ExprSuite) TestLogicalOperatorsShortCircuit(c *C) {
+	// does is not defined, evaluating it would be an error
+	inputs := []string{
+		"0 && does",
+		"1 || does",
+		"if(foo > 0, foo, does)",
+		"if(foo < 0, does, foo)",
+	}
+	for _, input := range inputs {
+		e, err := Compile(input)
+		c.Assert(err, IsNil)
+		_, err = e.Eval(s.c)
+		c.Check(err, IsNil, Commentf("%s: got evaluation error %s", input, err))
+	}
+
+	e, err := Compile("1 && does")
+	c.Assert(err, IsNil)
+	_, err = e.Eval(s.c)
+	c.Check(err, Not(IsNil))
+}
+
+func (s *ExprSuite) TestFallibleFunctionsReportErrors(c *C) {
+	c.Assert(RegisterFallibleFunction("checkedSqrt", 1, func(a []float64) (float64, error) {
+		if a[0] < 0 {
+			return math.NaN(), fmt.Errorf("negative argument %g", a[0])
+		}
+		return math.Sqrt(a[0]), nil
+	}), IsNil)
+	defer UnregisterFunction("checkedSqrt")
+	c.Assert(RegisterFunction("crash", 1, func(a []float64) float64 {
+		var values []float64
+		return values[int(a[0])]
+	}), IsNil)
+	defer UnregisterFunction("crash")
+	err := RegisterFallibleOperator("%%", 3, true, func(a []float64) (float64, error) {
+		if a[1] == 0 {
+			return math.NaN(), fmt.Errorf("modulo by zero")
+		}
+		return math.Mod(a[0], a[1]), nil
+	})
+	c.Assert(err, IsNil)
+	defer UnregisterOperator("%%")
+
+	e, err := Compile("checkedSqrt(foo + 1) + 7 %% 4")
+	c.Assert(err, IsNil)
+	res, err := e.Eval(s.c)
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, 5.0)
+
+	tests := []CompileError{
+		{"1 + checkedSqrt(-foo)", "Error in 'checkedSqrt()': negative argument -3"},
+		{"2 * (foo %% 0)", "Error in '%%': modulo by zero"},
+		{"crash(2)", "Error in 'crash()': panic: runtime error: index out of range [2] with length 0"},
+	}
+	for _, t := range tests {
+		e, err := Compile(t.input)
+		c.Assert(err, IsNil)
+		res, err := e.Eval(s.c)
+		c.Check(math.IsNaN(res), Equals, true)
+		var ferr *FunctionError
+		if c.Check(errors.As(err, &ferr), Equals, true, Commentf("%s: got %v", t.input, err)) == false {
+			continue
+		}
+		c.Check(err.Error(), Equals, t.error)
+	}
+}
+
+func (s *ExprSuite) TestVariadicFunctions(c *C) {
+	exps := []ExpResult{
+		{3.0, "max(foo)"},
+		{4.0, "max(1, 4, 2)"},
+		{-1.0, "min(1, -1, foo, 2)"},
+		{10.0, "sum(1, 2, 3, 4)"},
+		{7.0, "sum(foo, max(1, 4))"},
+		{2.0, "sum(min(3, 4), max(-1, if(1, -2, 3)))"},
+		{5.0, "max((1 + 2), 3) + 2"},
+	}
+
+	for i, e := range exps {
+		ee, err := Compile(e.Input)
+		if c.Check(err, IsNil, Commentf("[%d: %s]: got error at compilation : %s", i, e, err)) == false {
+			continue
+		}
+		res, err := ee.Eval(s.c)
+		if c.Check(err, IsNil, Commentf("[%d: %s]: got error at evaluation: %s", i, e, err)) == false {
+			continue
+		}
+		c.Check(res, Equals, e.Result, Commentf("[%d: %s]", i, e))
+	}
+}
+
+func (s *ExprSuite) TestOverloadedFunctions(c *C) {
+	c.Assert(RegisterFunction("norm", 1, func(a []float64) float64 { return math.Abs(a[0]) }), IsNil)
+	c.Assert(RegisterFunction("norm", 2, func(a []float64) float64 { return math.Hypot(a[0], a[1]) }), IsNil)
+	c.Assert(RegisterVariadicFunction("norm", 3, -1, func(a []float64) (float64, error) {
+		res := 0.0
+		for _, v := range a {
+			res += v * v
+		}
+		return math.Sqrt(res), nil
+	}), IsNil)
+	defer UnregisterFunction("norm")
+
+	exps := []ExpResult{
+		{3.0, "norm(-foo)"},
+		{5.0, "norm(3, 4)"},
+		{3.0, "norm(1, 2, 2)"},
+		{2.0, "norm(1, 1, 1, 1)"},
+	}
+	for i, e := range exps {
+		ee, err := Compile(e.Input)
+		if c.Check(err, IsNil, Commentf("[%d: %s]: got error at compilation : %s", i, e, err)) == false {
+			continue
+		}
+		res, err := ee.Eval(s.c)
+		if c.Check(err, IsNil, Commentf("[%d: %s]: got error at evaluation: %s", i, e, err)) == false {
+			continue
+		}
+		c.Check(res, Equals, e.Result, Commentf("[%d: %s]", i, e))
+	}
+
+	_, err := Compile("norm()")
+	c.Check(err, ErrorMatches, "1:1: 'norm\\(\\)' expects at least 1 argument, got 0")
+
+	c.Assert(RegisterFunction("clamp", 3, func(a []float64) float64 { return 0 }), IsNil)
+	c.Assert(RegisterFunction("clamp", 5, func(a []float64) float64 { return 0 }), IsNil)
+	defer UnregisterFunction("clamp")
+	_, err = Compile("clamp(1, 2)")
+	c.Check(err, ErrorMatches, "1:1: 'clamp\\(\\)' expects 3 or 5 arguments, got 2")
+	var aerr *ArityError
+	c.Assert(errors.As(err, &aerr), Equals, true)
+	c.Check(aerr.Accepted, DeepEquals, [][2]int{{3, 3}, {5, 5}})
+
+	l := NewLanguage()
+	c.Assert(l.RegisterFunction("f", 1, func(a []float64) float64 { return 0 }), IsNil)
+	c.Assert(l.RegisterFunction("f", 2, func(a []float64) float64 { return 0 }), IsNil)
+	c.Assert(l.RegisterVariadicFunction("f", 5, -1, func(a []float64) (float64, error) { return 0, nil }), IsNil)
+	_, err = l.Compile("f(1, 2, 3)")
+	c.Check(err, ErrorMatches, "1:1: 'f\\(\\)' expects 1 to 2 or at least 5 arguments, got 3")
+}
+
+// digits returns the base 10 number formed by the arguments, so the
+// order of the arguments is checked
+func digits(a []float64) float64 {
+	res := 0.0
+	for _, v := range a {
+		res = 10*res + v
+	}
+	return res
+}
+
+func (s *ExprSuite) TestArgumentsAreInSourceOrder(c *C) {
+	for card := uint(2); card <= 6; card++ {
+		c.Assert(RegisterFunction(fmt.Sprintf("digits%d", card), card, digits), IsNil)
+	}
+	c.Assert(RegisterVariadicFunction("digits", 0, -1, func(a []float64) (float64, error) { return digits(a), nil }), IsNil)
+	c.Assert(RegisterLazyFunction("lazyDigits", 3, func(args []Expression, ctx Context) (float64, error) {
+		values := make([]float64, len(args))
+		for i, a := range args {
+			var err error
+			if values[i], err = a.Eval(ctx); err != nil {
+				return math.NaN(), err
+			}
+		}
+		return digits(values), nil
+	}), IsNil)
+	c.Assert(RegisterFunction("clamp", 3, func(a []float64) float64 {
+		return math.Max(a[1], math.Min(a[0], a[2]))
+	}), IsNil)
+	defer func() {
+		for card := 2; card <= 6; card++ {
+			UnregisterFunction(fmt.Sprintf("digits%d", card))
+		}
+		UnregisterFunction("digits")
+		UnregisterFunction("lazyDigits")
+		UnregisterFunction("clamp")
+	}()
+
+	exps := []ExpResult{
+		{math.Atan2(1, 2), "atan2(1, 2)"},
+		{math.Atan2(2, 1), "atan2(2, 1)"},
+		{math.Atan2(-1, 3), "atan2(-1, foo)"},
+		{math.Atan2(3, math.Atan2(1, 2)), "atan2(foo, atan2(1, 2))"},
+		{1.0, "if(1, 1, 2)"},
+		{2.0, "if(0, 1, 2)"},
+		{12.0, "digits2(1, 2)"},
+		{123.0, "digits3(1, 2, 3)"},
+		{1234.0, "digits4(1, 2, 3, 4)"},
+		{12345.0, "digits5(1, 2, 3, 4, 5)"},
+		{123456.0, "digits6(1, 2, 3, 4, 5, 6)"},
+		{12345678.0, "digits(1, 2, 3, 4, 5, 6, 7, 8)"},
+		{321.0, "lazyDigits(foo, 2, 1)"},
+		{132.0, "digits3(1, foo, 2)"},
+		{5243.0, "digits2(5, 2) * 100 + digits2(4, foo)"},
+		{613.0, "digits3(digits2(2, 4) / 4, 1, foo)"},
+		{2.0, "clamp(2, 1, foo)"},
+		{1.0, "clamp(-2, 1, foo)"},
+		{3.0, "clamp(10, 1, foo)"},
+	}
+
+	for i, e := range exps {
+		ee, err := Compile(e.Input)
+		if c.Check(err, IsNil, Commentf("[%d: %s]: got error at compilation : %s", i, e, err)) == false {
+			continue
+		}
+		res, err := ee.Eval(s.c)
+		if c.Check(err, IsNil, Commentf("[%d: %s]: got error at evaluation: %s", i, e, err)) == false {
+			continue
+		}
+		c.Check(res, Equals, e.Result, Commentf("[%d: %s]", i, e))
 	}
 }
 
 func (s *ExprSuite) TestCanRegisterOperator(c *C) {
-	err := RegisterOperator("<", 10, false, func(a []float64) float64 {
+	err := RegisterOperator("<<", 1, false, func(a []float64) float64 {
 		if a[0] < a[1] {
 			return 1.0
 		}
 		return 0.0
 	})
 	c.Assert(err, IsNil)
-	defer delete(operators, tokUserStart)
+	defer UnregisterOperator("<<")
 
-	err = RegisterOperator(">", 10, false, func(a []float64) float64 {
+	err = RegisterOperator(">>", 1, false, func(a []float64) float64 {
 		if a[0] > a[1] {
 			return 1.0
 		}
@@ -224,10 +577,10 @@ func (s *ExprSuite) TestCanRegisterOperator(c *C) {
 	})
 
 	c.Assert(err, IsNil)
-	defer delete(operators, tokUserStart+1)
+	defer UnregisterOperator(">>")
 
 	// Here the precedence should make sure that - is popped out
-	e, err := Compile("1.0 - 0.6 < 0.5")
+	e, err := Compile("1.0 - 0.6 << 0.5")
 	c.Assert(err, IsNil)
 
 	res, err := e.Eval(nil)
@@ -250,3 +603,233 @@ func (s *ExprSuite) TestCanRegisterOperator(c *C) {
 
 	MustRegisterOperator(">a", 10, false, func(a []float64) float64 { return 0 })
 }
+
+func (s *ExprSuite) TestCanRegisterPrefixOperator(c *C) {
+	err := RegisterPrefixOperator("~", 4, func(a []float64) float64 {
+		return 1.0 / a[0]
+	})
+	c.Assert(err, IsNil)
+	defer UnregisterPrefixOperator("~")
+
+	e, err := Compile("2 * ~foo^2")
+	c.Assert(err, IsNil)
+
+	res, err := e.Eval(s.c)
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, 2.0/9.0)
+
+	// it is not a binary operator
+	_, err = Compile("2 ~ 3")
+	c.Check(err, Not(IsNil))
+
+	err = RegisterPrefixOperator("(", 4, func(a []float64) float64 { return 0 })
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, "Cannot use \"(\" as a prefix operator")
+
+	didPanic := false
+	defer func() {
+		if r := recover(); r != nil {
+			didPanic = true
+		}
+		c.Check(didPanic, Equals, true)
+	}()
+
+	MustRegisterPrefixOperator("~a", 4, func(a []float64) float64 { return 0 })
+}
+
+func (s *ExprSuite) TestLazyFunctionReceivesContext(c *C) {
+	// returns the value of the first defined argument
+	RegisterLazyFunction("coalesce", 2, func(args []Expression, ctx Context) (float64, error) {
+		if name, ok := ReferenceName(args[0]); ok == true && ctx != nil {
+			if _, err := ctx.GetExpression(name); err != nil {
+				return args[1].Eval(ctx)
+			}
+		}
+		return args[0].Eval(ctx)
+	})
+	defer UnregisterFunction("coalesce")
+
+	e, err := Compile("coalesce(does, 2) + coalesce(foo, 2)")
+	c.Assert(err, IsNil)
+	res, err := e.Eval(s.c)
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, 5.0)
+}
+
+func (s *ExprSuite) TestScopeDetectsCycles(c *C) {
+	RegisterLazyFunction("twice", 1, func(args []Expression, ctx Context) (float64, error) {
+		scope := NewScopeContext(ctx)
+		scope.Set("x", 2.0)
+		return args[0].Eval(scope)
+	})
+	defer UnregisterFunction("twice")
+
+	s.c.CompileAndAdd("bar", "twice(x * bar)")
+	defer s.c.Delete("bar")
+
+	e, err := Compile("bar")
+	c.Assert(err, IsNil)
+	_, err = e.Eval(s.c)
+	var cerr *CyclicDependencyError
+	c.Check(errors.As(err, &cerr), Equals, true, Commentf("Got error %s", err))
+
+	_, err = NewScopeContext(nil).GetExpression("x")
+	c.Check(err, ErrorMatches, "Could not find 'x' in ScopeContext")
+}
+
+func ExampleRegisterLazyFunction() {
+	// sigma(i, from, to, expr) sums expr for i from from to to
+	err := RegisterLazyFunction("sigma", 4, func(args []Expression, c Context) (float64, error) {
+		name, ok := ReferenceName(args[0])
+		if ok == false {
+			return math.NaN(), fmt.Errorf("sigma() first argument should be a variable")
+		}
+		from, err := args[1].Eval(c)
+		if err != nil {
+			return math.NaN(), err
+		}
+		to, err := args[2].Eval(c)
+		if err != nil {
+			return math.NaN(), err
+		}
+		scope := NewScopeContext(c)
+		res := 0.0
+		for i := from; i <= to; i++ {
+			scope.Set(name, i)
+			v, err := args[3].Eval(scope)
+			if err != nil {
+				return math.NaN(), err
+			}
+			res += v
+		}
+		return res, nil
+	})
+	if err != nil {
+		fmt.Printf("Got error: %s", err)
+		return
+	}
+	defer UnregisterFunction("sigma")
+
+	expr, err := Compile("sigma(i, 1, 10, i^2)")
+	if err != nil {
+		fmt.Printf("Got error: %s", err)
+		return
+	}
+
+	res, err := expr.Eval(nil)
+	if err != nil {
+		fmt.Printf("Got error: %s", err)
+		return
+	}
+	fmt.Printf("%f", res)
+	//Output: 385.000000
+}
+
+func (s *ExprSuite) TestRegistrationConflicts(c *C) {
+	c.Assert(RegisterFunction("square", 1, func(a []float64) float64 { return a[0] * a[0] }), IsNil)
+	defer UnregisterFunction("square")
+	c.Assert(RegisterVariadicFunction("square", 2, 3, func(a []float64) (float64, error) { return 0, nil }), IsNil)
+
+	err := RegisterFunction("square", 1, func(a []float64) float64 { return a[0] })
+	var cerr *ConflictError
+	c.Assert(errors.As(err, &cerr), Equals, true)
+	c.Check(err, ErrorMatches, "Already registered function 'square\\(\\)'")
+	c.Check(RegisterVariadicFunction("square", 3, -1, func(a []float64) (float64, error) { return 0, nil }), ErrorMatches, "Already registered function 'square\\(\\)'")
+	// a variadic overload could overlap a fixed one
+	c.Check(RegisterVariadicFunction("square", 0, 1, func(a []float64) (float64, error) { return 0, nil }), IsNil)
+	// no call could be accepted
+	c.Check(RegisterVariadicFunction("bad", 3, 1, func(a []float64) (float64, error) { return 0, nil }), ErrorMatches, "'bad\\(\\)' cannot accept between 3 and 1 arguments")
+	c.Check(LookupFunction("bad"), IsNil)
+
+	c.Check(LookupFunction("square"), DeepEquals, []FunctionInfo{
+		{Name: "square", MinArgs: 0, MaxArgs: 1},
+		{Name: "square", MinArgs: 1, MaxArgs: 1},
+		{Name: "square", MinArgs: 2, MaxArgs: 3},
+	})
+	c.Check(LookupFunction("if"), DeepEquals, []FunctionInfo{{Name: "if", MinArgs: 3, MaxArgs: 3, Lazy: true}})
+	c.Check(LookupFunction("does"), IsNil)
+
+	e, err := Compile("square(3)")
+	c.Assert(err, IsNil)
+
+	// replacing a function requires to unregister it first
+	c.Check(UnregisterFunction("square"), Equals, true)
+	c.Check(UnregisterFunction("square"), Equals, false)
+	c.Assert(RegisterFunction("square", 1, func(a []float64) float64 { return -a[0] }), IsNil)
+
+	// already compiled expressions are not affected
+	res, err := e.Eval(nil)
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, 9.0)
+	e, err = Compile("square(3)")
+	c.Assert(err, IsNil)
+	res, err = e.Eval(nil)
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, -3.0)
+
+	err = RegisterOperator("+", 2, true, func(a []float64) float64 { return 0 })
+	c.Check(err, ErrorMatches, "Already registered operator '\\+'")
+	err = RegisterPrefixOperator("-", 4, func(a []float64) float64 { return 0 })
+	c.Check(err, ErrorMatches, "Already registered prefix operator '-'")
+
+	info, ok := LookupOperator("^")
+	c.Check(ok, Equals, true)
+	c.Check(info, Equals, OperatorInfo{Token: "^", Precedence: 4, LeftAssociative: false})
+	_, ok = LookupPrefixOperator("^")
+	c.Check(ok, Equals, false)
+	_, ok = LookupOperator("!")
+	c.Check(ok, Equals, false)
+	_, ok = LookupPrefixOperator("!")
+	c.Check(ok, Equals, true)
+	c.Check(UnregisterOperator("@@@"), Equals, false)
+}
+
+func (s *ExprSuite) TestConcurrentRegistration(c *C) {
+	var wg sync.WaitGroup
+	errs := make(chan error, 200)
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("concurrent%d", i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := RegisterFunction(name, 1, func(a []float64) float64 { return 2 * a[0] }); err != nil {
+				errs <- err
+				return
+			}
+			if err := RegisterOperator("#", 3, true, func(a []float64) float64 { return a[0] }); err != nil {
+				if _, ok := err.(*ConflictError); ok == false {
+					errs <- err
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			e, err := Compile("sin(foo) + 2 * -max(1, foo)")
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, err := e.Eval(s.c); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Error(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("concurrent%d", i)
+		e, err := Compile(name + "(2) # 1")
+		if c.Check(err, IsNil) == false {
+			continue
+		}
+		res, err := e.Eval(nil)
+		c.Check(err, IsNil)
+		c.Check(res, Equals, 4.0)
+		UnregisterFunction(name)
+	}
+	UnregisterOperator("#")
+}
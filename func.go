@@ -0,0 +1,76 @@
+package meval
+
+// CompileFunc compiles input with the default Language into a Go
+// function, see Language.CompileFunc.
+func CompileFunc(input string, params ...string) (func(...float64) (float64, error), error) {
+	return defaultLanguage.CompileFunc(input, params...)
+}
+
+// Func1 compiles input with the default Language into a Go function
+// of one parameter, see Language.Func1.
+func Func1(input, param string) (func(float64) (float64, error), error) {
+	return defaultLanguage.Func1(input, param)
+}
+
+// Func2 compiles input with the default Language into a Go function
+// of two parameters, see Language.Func2.
+func Func2(input, param1, param2 string) (func(float64, float64) (float64, error), error) {
+	return defaultLanguage.Func2(input, param1, param2)
+}
+
+// CompileFunc compiles input into a Go function, whose arguments are
+// the values of params, in order. Any other variable referenced by
+// input is rejected with an *UndefinedVariableError. Like Dependencies,
+// it cannot tell the variables bound by a lazy function, that must
+// be declared as parameters.
+//
+// The returned function fails if it is not called with exactly one
+// argument per parameter. It is safe for concurrent use.
+func (l *Language) CompileFunc(input string, params ...string) (func(...float64) (float64, error), error) {
+	p, err := l.compileFunc(input, params...)
+	if err != nil {
+		return nil, err
+	}
+	return func(args ...float64) (float64, error) {
+		return p.Eval(args)
+	}, nil
+}
+
+// Func1 is like CompileFunc for a function of one parameter.
+func (l *Language) Func1(input, param string) (func(float64) (float64, error), error) {
+	p, err := l.compileFunc(input, param)
+	if err != nil {
+		return nil, err
+	}
+	return func(x float64) (float64, error) {
+		return p.Eval([]float64{x})
+	}, nil
+}
+
+// Func2 is like CompileFunc for a function of two parameters.
+func (l *Language) Func2(input, param1, param2 string) (func(float64, float64) (float64, error), error) {
+	p, err := l.compileFunc(input, param1, param2)
+	if err != nil {
+		return nil, err
+	}
+	return func(x, y float64) (float64, error) {
+		return p.Eval([]float64{x, y})
+	}, nil
+}
+
+func (l *Language) compileFunc(input string, params ...string) (*Program, error) {
+	e, err := l.Compile(input)
+	if err != nil {
+		return nil, err
+	}
+	declared := make(map[string]bool, len(params))
+	for _, p := range params {
+		declared[p] = true
+	}
+	for _, d := range Dependencies(e) {
+		if declared[d] == false {
+			return nil, &UndefinedVariableError{Name: d, Context: "parameters"}
+		}
+	}
+	return NewProgram(e, nil, params...)
+}
@@ -0,0 +1,72 @@
+package meval
+
+import (
+	"errors"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type FuncSuite struct{}
+
+var _ = Suite(&FuncSuite{})
+
+func (s *FuncSuite) TestCompileFunc(c *C) {
+	f, err := CompileFunc("a * x ^ 2 + b * x + c", "x", "a", "b", "c")
+	c.Assert(err, IsNil)
+	res, err := f(2, 1, -3, 4)
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, 2.0)
+	_, err = f(2, 1)
+	c.Check(err, ErrorMatches, "Program expects 4 values, got 2")
+
+	square, err := Func1("x * x", "x")
+	c.Assert(err, IsNil)
+	res, err = square(3)
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, 9.0)
+
+	hypot, err := Func2("sqrt(x ^ 2 + y ^ 2)", "x", "y")
+	c.Assert(err, IsNil)
+	res, err = hypot(3, 4)
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, 5.0)
+
+	// unused parameters are allowed
+	constant, err := Func1("pi()", "x")
+	c.Assert(err, IsNil)
+	res, err = constant(1)
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, 3.141592653589793)
+}
+
+func (s *FuncSuite) TestRejectsUnknownIdentifiers(c *C) {
+	_, err := Func2("x * z + y", "x", "y")
+	var uerr *UndefinedVariableError
+	c.Assert(errors.As(err, &uerr), Equals, true)
+	c.Check(uerr.Name, Equals, "z")
+	c.Check(err, ErrorMatches, "Could not find 'z' in parameters")
+
+	_, err = CompileFunc("x +", "x")
+	c.Check(err, ErrorMatches, "1:4: Unexpected end of input")
+
+	// functions are looked up in the Language
+	l := NewLanguage()
+	c.Assert(l.RegisterFunction("half", 1, func(a []float64) float64 { return a[0] / 2 }), IsNil)
+	half, err := l.Func1("half(x)", "x")
+	c.Assert(err, IsNil)
+	res, err := half(3)
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, 1.5)
+	_, err = Func1("half(x)", "x")
+	c.Check(err, Not(IsNil))
+}
+
+func (s *FuncSuite) TestDoesNotAllocate(c *C) {
+	f, err := Func2("x * sin(y) + max(x, y)", "x", "y")
+	c.Assert(err, IsNil)
+	allocs := testing.AllocsPerRun(100, func() {
+		f(1, 2)
+	})
+	c.Check(allocs, Equals, 0.0)
+}
@@ -0,0 +1,318 @@
+package meval
+
+import (
+	"math"
+)
+
+// EvalGradient evaluates e within c, and returns its value with its
+// gradient with respect to variables in a single pass, using forward
+// mode automatic differentiation.
+//
+// The variables are looked up in c, and are considered independent:
+// their own definitions are evaluated, but not differentiated. Any
+// other reference is followed through c like Eval does, so the
+// gradient includes the dependencies of the variables it refers to.
+//
+// Built-in operators and functions are differentiated exactly, as
+// well as the functions registered with the Derivatives option. The
+// partial derivatives of other functions and operators are
+// approximated with finite differences. A call to an Impure or a
+// lazy function whose result depends on variables fails with a
+// *DerivativeError. Expression types not returned by Compile are
+// considered as constants.
+func EvalGradient(e Expression, c Context, variables []string) (float64, []float64, error) {
+	g := &gradientEval{
+		variables: variables,
+		seeds:     make(map[string]bool, len(variables)),
+	}
+	for _, v := range variables {
+		g.seeds[v] = true
+	}
+	res, err := g.eval(e, c)
+	if err != nil {
+		return math.NaN(), nil, err
+	}
+	grad := make([]float64, len(variables))
+	copy(grad, res.grad)
+	return res.value, grad, nil
+}
+
+// dual is a value with its gradient
+type dual struct {
+	value float64
+	// nil if the gradient is null
+	grad []float64
+}
+
+type gradientEval struct {
+	variables []string
+	seeds     map[string]bool
+}
+
+// seed returns the gradient of an independent variable
+func (g *gradientEval) seed(name string) []float64 {
+	grad := make([]float64, len(g.variables))
+	for i, v := range g.variables {
+		if v == name {
+			grad[i] = 1
+		}
+	}
+	return grad
+}
+
+// linear returns the gradient of a function of args, given its
+// partial derivatives. Arguments with a null gradient are skipped,
+// so their partial derivative is never used.
+func (g *gradientEval) linear(partials []float64, args []dual) []float64 {
+	var res []float64
+	for i, a := range args {
+		if a.grad == nil {
+			continue
+		}
+		if res == nil {
+			res = make([]float64, len(g.variables))
+		}
+		for j, d := range a.grad {
+			res[j] += partials[i] * d
+		}
+	}
+	return res
+}
+
+// dependsOnSeeds returns true if e references any of the variables,
+// directly or not.
+func (g *gradientEval) dependsOnSeeds(e Expression, c Context) bool {
+	for _, d := range TransitiveDependencies(e, c) {
+		if g.seeds[d] == true {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *gradientEval) evalAll(exprs []Expression, c Context) ([]dual, []float64, bool, error) {
+	args := make([]dual, len(exprs))
+	values := make([]float64, len(exprs))
+	constant := true
+	for i, e := range exprs {
+		var err error
+		if args[i], err = g.eval(e, c); err != nil {
+			return nil, nil, false, err
+		}
+		values[i] = args[i].value
+		constant = constant && args[i].grad == nil
+	}
+	return args, values, constant, nil
+}
+
+func (g *gradientEval) eval(e Expression, c Context) (dual, error) {
+	switch n := e.(type) {
+	case *valueExp:
+		return dual{value: n.value}, nil
+	case *refExp:
+		return g.evalRef(n, c)
+	case *cachedExp:
+		// the memoized value cannot be used, as it has no gradient
+		return g.eval(n.expr, &evalFrame{Context: n.ctx, stack: frameOf(c).stack})
+	case *unaryExp:
+		return g.evalOperator(n.name, n.builtin, n.impure, []Expression{n.child}, func(a []float64) (float64, error) {
+			return n.evaluer(a[0])
+		}, c)
+	case *binaryExp:
+		return g.evalOperator(n.name, n.builtin, n.impure, []Expression{n.leftChild, n.rightChild}, func(a []float64) (float64, error) {
+			return n.evaluer(a[0], a[1])
+		}, c)
+	case *nExp:
+		return g.evalCall(n, c)
+	case *lazyExp:
+		if n.builtin == true && n.name == "if" {
+			cond, err := g.eval(n.children[0], c)
+			if err != nil {
+				return dual{}, err
+			}
+			if cond.value != 0 {
+				return g.eval(n.children[1], c)
+			}
+			return g.eval(n.children[2], c)
+		}
+		return g.evalLazy(n, n.name+"()", n.builtin, c)
+	case *lazyBinaryExp:
+		return g.evalLazy(n, n.name, n.builtin, c)
+	}
+	v, err := e.Eval(c)
+	return dual{value: v}, err
+}
+
+// evalRef follows a reference like refExp.Eval
+func (g *gradientEval) evalRef(e *refExp, c Context) (dual, error) {
+	if g.seeds[e.variable] == true {
+		v, err := e.Eval(c)
+		if err != nil {
+			return dual{}, err
+		}
+		return dual{value: v, grad: g.seed(e.variable)}, nil
+	}
+	if c == nil {
+		return dual{}, &NoContextError{Name: e.variable}
+	}
+
+	f := frameOf(c)
+	if bad, deps := f.stack.testStack(e); bad == true {
+		deps = append([]string{deps[len(deps)-1]},
+			deps...)
+		return dual{}, &CyclicDependencyError{Cycle: deps}
+	}
+	f.stack.push(e)
+	defer f.stack.pop()
+	expr, err := f.GetExpression(e.variable)
+	if err != nil {
+		return dual{}, err
+	}
+	res, err := g.eval(expr, f)
+	if err != nil {
+		return dual{}, wrapEvalError(e.variable, err)
+	}
+	return res, nil
+}
+
+// evalOperator evaluates a prefix or a binary operator
+func (g *gradientEval) evalOperator(name string, builtin, impure bool, operands []Expression, evaluer FallibleEvaluer, c Context) (dual, error) {
+	args, values, constant, err := g.evalAll(operands, c)
+	if err != nil {
+		return dual{}, err
+	}
+	v, err := evaluer(values)
+	if err != nil || constant == true {
+		return dual{value: v}, err
+	}
+	if impure == true {
+		return dual{}, &DerivativeError{Name: name}
+	}
+	if builtin == false {
+		partials, err := finiteDifferences(name, evaluer, args, values)
+		if err != nil {
+			return dual{}, err
+		}
+		return dual{value: v, grad: g.linear(partials, args)}, nil
+	}
+
+	var partials []float64
+	if len(args) == 1 {
+		switch name {
+		case "+":
+			partials = []float64{1}
+		case "-":
+			partials = []float64{-1}
+		}
+	} else {
+		a, b := values[0], values[1]
+		switch name {
+		case "+":
+			partials = []float64{1, 1}
+		case "-":
+			partials = []float64{1, -1}
+		case "*":
+			partials = []float64{b, a}
+		case "/":
+			partials = []float64{1 / b, -a / (b * b)}
+		case "^":
+			partials = []float64{b * math.Pow(a, b-1), v * math.Log(a)}
+		}
+	}
+	if partials == nil {
+		// comparisons are piecewise constant
+		return dual{value: v}, nil
+	}
+	return dual{value: v, grad: g.linear(partials, args)}, nil
+}
+
+func (g *gradientEval) evalCall(e *nExp, c Context) (dual, error) {
+	args, values, constant, err := g.evalAll(e.children, c)
+	if err != nil {
+		return dual{}, err
+	}
+	v, err := e.evaluer(values)
+	if err != nil || constant == true {
+		return dual{value: v}, err
+	}
+	if e.impure == true {
+		return dual{}, &DerivativeError{Name: e.name + "()"}
+	}
+	if e.derive == nil {
+		partials, err := finiteDifferences(e.name+"()", e.evaluer, args, values)
+		if err != nil {
+			return dual{}, err
+		}
+		return dual{value: v, grad: g.linear(partials, args)}, nil
+	}
+
+	// the symbolic partial derivatives are evaluated at the
+	// arguments
+	call := *e
+	call.children = make([]Expression, len(values))
+	for i, v := range values {
+		call.children[i] = &valueExp{value: v}
+	}
+	partials := make([]float64, len(args))
+	for i, a := range args {
+		if a.grad == nil {
+			continue
+		}
+		dargs := make([]Expression, len(args))
+		for j := range dargs {
+			dargs[j] = zero()
+		}
+		dargs[i] = one()
+		d, err := e.derive(&call, dargs)
+		if err != nil {
+			return dual{}, err
+		}
+		if partials[i], err = d.Eval(nil); err != nil {
+			return dual{}, err
+		}
+	}
+	return dual{value: v, grad: g.linear(partials, args)}, nil
+}
+
+// evalLazy evaluates a lazy function or operator, whose derivative is
+// only known to be null if it does not depend on the variables, or
+// for the built-in logical operators.
+func (g *gradientEval) evalLazy(e Expression, name string, builtin bool, c Context) (dual, error) {
+	v, err := e.Eval(c)
+	if err != nil {
+		return dual{}, err
+	}
+	if builtin == false && g.dependsOnSeeds(e, c) == true {
+		return dual{}, &DerivativeError{Name: name}
+	}
+	return dual{value: v}, nil
+}
+
+// finiteDifferences approximates the partial derivatives of evaluer
+// with respect to the arguments that have a gradient, using central
+// differences.
+func finiteDifferences(name string, evaluer FallibleEvaluer, args []dual, values []float64) ([]float64, error) {
+	// optimal step for central differences
+	step := math.Cbrt(2.220446049250313e-16)
+	partials := make([]float64, len(args))
+	shifted := make([]float64, len(values))
+	for i, a := range args {
+		if a.grad == nil {
+			continue
+		}
+		h := step * math.Max(1, math.Abs(values[i]))
+		copy(shifted, values)
+		shifted[i] = values[i] + h
+		after, err := evaluer(shifted)
+		if err != nil {
+			return nil, &DerivativeError{Name: name}
+		}
+		shifted[i] = values[i] - h
+		before, err := evaluer(shifted)
+		if err != nil {
+			return nil, &DerivativeError{Name: name}
+		}
+		partials[i] = (after - before) / (2 * h)
+	}
+	return partials, nil
+}
@@ -0,0 +1,166 @@
+package meval
+
+import (
+	"errors"
+	"math"
+
+	. "gopkg.in/check.v1"
+)
+
+type GradientSuite struct{}
+
+var _ = Suite(&GradientSuite{})
+
+func (s *GradientSuite) TestMatchesDerive(c *C) {
+	inputs := []string{
+		"a * b - a / b",
+		"a ^ b + 2 ^ a + b ^ 3",
+		"sin(a * b) + cos(a) * tan(b)",
+		"exp(a) * ln(b) + log(a * b) + sqrt(a + b)",
+		"atan2(a, b) + asin(a / 2) + acos(b / 3) + atan(a * b)",
+		"min(a, b) + max(2 * a, b) + sum(a, b, a * b)",
+		"if(a > b, a ^ 2, -b) + (a < b) + floor(a)",
+	}
+	ctx := NewMapContext()
+	for _, point := range [][2]float64{{0.4, 0.9}, {1.3, 0.7}} {
+		ctx.Add("a", NewValue(point[0]))
+		ctx.Add("b", NewValue(point[1]))
+		for _, input := range inputs {
+			e, err := Compile(input)
+			c.Assert(err, IsNil)
+			value, grad, err := EvalGradient(e, ctx, []string{"a", "b"})
+			c.Assert(err, IsNil, Commentf("input: %s", input))
+			expected, err := e.Eval(ctx)
+			c.Assert(err, IsNil)
+			c.Check(value, Equals, expected, Commentf("input: %s", input))
+			c.Assert(grad, HasLen, 2)
+			for i, v := range []string{"a", "b"} {
+				d, err := Derive(e, v)
+				c.Assert(err, IsNil)
+				expected, err := d.Eval(ctx)
+				c.Assert(err, IsNil)
+				c.Check(math.Abs(grad[i]-expected) < 1e-12, Equals, true,
+					Commentf("d(%s)/d%s at %v: got %g, expected %g", input, v, point, grad[i], expected))
+			}
+		}
+	}
+}
+
+func (s *GradientSuite) TestFollowsReferences(c *C) {
+	ctx := NewMapContext()
+	c.Assert(ctx.CompileAndAdd("a", "2"), IsNil)
+	c.Assert(ctx.CompileAndAdd("b", "3 * a"), IsNil)
+	c.Assert(ctx.CompileAndAdd("area", "a * b"), IsNil)
+
+	e, err := Compile("area + b")
+	c.Assert(err, IsNil)
+	value, grad, err := EvalGradient(e, ctx, []string{"a"})
+	c.Assert(err, IsNil)
+	c.Check(value, Equals, 18.0)
+	c.Check(grad, DeepEquals, []float64{15.0})
+
+	// b is independent, its definition is not differentiated
+	value, grad, err = EvalGradient(e, ctx, []string{"a", "b", "c"})
+	c.Assert(err, IsNil)
+	c.Check(value, Equals, 18.0)
+	c.Check(grad, DeepEquals, []float64{6.0, 3.0, 0.0})
+
+	// values memoized by a CachedContext are differentiated as well
+	cached := NewCachedContext()
+	c.Assert(cached.CompileAndAdd("x", "3"), IsNil)
+	c.Assert(cached.CompileAndAdd("y", "x ^ 2"), IsNil)
+	e, err = Compile("y")
+	c.Assert(err, IsNil)
+	_, err = e.Eval(cached)
+	c.Assert(err, IsNil)
+	value, grad, err = EvalGradient(e, cached, []string{"x"})
+	c.Assert(err, IsNil)
+	c.Check(value, Equals, 9.0)
+	c.Check(grad, DeepEquals, []float64{6.0})
+
+	e, err = Compile("2 * pi()")
+	c.Assert(err, IsNil)
+	value, grad, err = EvalGradient(e, nil, []string{"x"})
+	c.Assert(err, IsNil)
+	c.Check(value, Equals, 2*math.Pi)
+	c.Check(grad, DeepEquals, []float64{0.0})
+}
+
+func (s *GradientSuite) TestErrors(c *C) {
+	c.Assert(RegisterLazyFunction("twice", 1, func(a []Expression, c Context) (float64, error) {
+		v, err := a[0].Eval(c)
+		return 2 * v, err
+	}), IsNil)
+	defer UnregisterFunction("twice")
+	c.Assert(RegisterFunction("jitter", 1, func(a []float64) float64 { return a[0] }, Impure), IsNil)
+	defer UnregisterFunction("jitter")
+
+	ctx := NewMapContext()
+	c.Assert(ctx.CompileAndAdd("x", "1"), IsNil)
+	c.Assert(ctx.CompileAndAdd("y", "twice(x)"), IsNil)
+	c.Assert(ctx.CompileAndAdd("loop", "loop + x"), IsNil)
+
+	tests := []struct {
+		input, error string
+	}{
+		{"z * x", "Could not find 'z' in MapContext"},
+		{"loop", "in loop -> loop: Got cyclic dependency loop -> loop"},
+		{"jitter(x ^ 2)", "Cannot differentiate 'jitter\\(\\)'"},
+		{"1 + y", "in y: Cannot differentiate 'twice\\(\\)'"},
+	}
+	for _, t := range tests {
+		e, err := Compile(t.input)
+		c.Assert(err, IsNil)
+		_, _, err = EvalGradient(e, ctx, []string{"x"})
+		c.Check(err, ErrorMatches, t.error, Commentf("input: %s", t.input))
+	}
+
+	e, err := Compile("x")
+	c.Assert(err, IsNil)
+	_, _, err = EvalGradient(e, nil, []string{"y"})
+	var nerr *NoContextError
+	c.Check(errors.As(err, &nerr), Equals, true)
+
+	// calls that do not depend on the variables are constant
+	e, err = Compile("twice(3) * x + jitter(2) + rand()")
+	c.Assert(err, IsNil)
+	_, grad, err := EvalGradient(e, ctx, []string{"x"})
+	c.Assert(err, IsNil)
+	c.Check(grad, DeepEquals, []float64{6.0})
+}
+
+func (s *GradientSuite) TestUserFunctions(c *C) {
+	l := NewLanguage()
+	c.Assert(l.RegisterFunction("cube", 1, func(a []float64) float64 { return a[0] * a[0] * a[0] },
+		Derivatives("3 * x1^2")), IsNil)
+	c.Assert(l.RegisterFunction("hypot", 2, func(a []float64) float64 { return math.Hypot(a[0], a[1]) }), IsNil)
+	c.Assert(l.RegisterOperator("%", 3, true, func(a []float64) float64 { return math.Mod(a[0], a[1]) }), IsNil)
+
+	ctx := NewMapContext()
+	ctx.Add("a", NewValue(3))
+	ctx.Add("b", NewValue(4))
+
+	tests := []struct {
+		input    string
+		expected []float64
+		exact    bool
+	}{
+		{"cube(a * b)", []float64{3 * 144 * 4, 3 * 144 * 3}, true},
+		{"hypot(a, b)", []float64{0.6, 0.8}, false},
+		{"b % a", []float64{-1, 1}, false},
+	}
+	for _, t := range tests {
+		e, err := l.Compile(t.input)
+		c.Assert(err, IsNil)
+		_, grad, err := EvalGradient(e, ctx, []string{"a", "b"})
+		c.Assert(err, IsNil, Commentf("input: %s", t.input))
+		if t.exact == true {
+			c.Check(grad, DeepEquals, t.expected, Commentf("input: %s", t.input))
+			continue
+		}
+		for i := range grad {
+			c.Check(math.Abs(grad[i]-t.expected[i]) < 1e-8, Equals, true,
+				Commentf("input: %s, got %v", t.input, grad))
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package meval
+
+// A Language holds the operators and functions used to compile
+// expressions. Functions and operators registered in a Language do
+// not affect other ones, so a Language can be used to offer a
+// restricted dialect, or to keep the symbols of a library private.
+//
+// A Language is safe for concurrent use, registration can happen
+// while other goroutines compile. The zero value is a Language
+// without any operator or function, like NewEmptyLanguage returns.
+type Language struct {
+	registry registry
+}
+
+// builtins are the symbols of the built-in operators and functions.
+var builtins *symbols
+
+// defaultLanguage is used by Compile and by the package level
+// Register functions.
+var defaultLanguage = NewEmptyLanguage()
+
+// NewLanguage creates a Language with all the built-in operators and
+// functions. Functions and operators registered at the package level
+// are not part of it.
+func NewLanguage() *Language {
+	return &Language{registry: registry{symbols: builtins}}
+}
+
+// NewEmptyLanguage creates a Language without any operator or
+// function. Only parentheses and comma are known by the Lexer.
+func NewEmptyLanguage() *Language {
+	return &Language{registry: registry{symbols: newSymbols()}}
+}
+
+// DefaultLanguage returns the Language used by Compile and by the
+// package level Register functions.
+func DefaultLanguage() *Language {
+	return defaultLanguage
+}
+
+// Clone returns a copy of l, that can be modified independently.
+func (l *Language) Clone() *Language {
+	return &Language{registry: registry{symbols: l.registry.load()}}
+}
+
+// Compile a new expression from an input string, using the operators
+// and functions of l.
+func (l *Language) Compile(input string) (Expression, error) {
+	return buildAST(input, l.registry.load())
+}
+
+// RegisterFunction registers a new function in the default Language,
+// see Language.RegisterFunction.
+func RegisterFunction(name string, cardinality uint, evaluer NEvaluer, options ...FunctionOption) error {
+	return defaultLanguage.RegisterFunction(name, cardinality, evaluer, options...)
+}
+
+// RegisterFallibleFunction registers a new function in the default
+// Language, see Language.RegisterFallibleFunction.
+func RegisterFallibleFunction(name string, cardinality uint, evaluer FallibleEvaluer, options ...FunctionOption) error {
+	return defaultLanguage.RegisterFallibleFunction(name, cardinality, evaluer, options...)
+}
+
+// RegisterVariadicFunction registers a new function in the default
+// Language, see Language.RegisterVariadicFunction.
+func RegisterVariadicFunction(name string, minCard, maxCard int, evaluer FallibleEvaluer, options ...FunctionOption) error {
+	return defaultLanguage.RegisterVariadicFunction(name, minCard, maxCard, evaluer, options...)
+}
+
+// RegisterLazyFunction registers a new function in the default
+// Language, see Language.RegisterLazyFunction.
+func RegisterLazyFunction(name string, cardinality uint, evaluer LazyEvaluer, options ...FunctionOption) error {
+	return defaultLanguage.RegisterLazyFunction(name, cardinality, evaluer, options...)
+}
+
+// RegisterOperator registers a new binary operator in the default
+// Language, see Language.RegisterOperator.
+func RegisterOperator(opToken string,
+	precedence int,
+	leftAssociative bool,
+	evaluer NEvaluer,
+	options ...FunctionOption) error {
+	return defaultLanguage.RegisterOperator(opToken, precedence, leftAssociative, evaluer, options...)
+}
+
+// RegisterFallibleOperator registers a new binary operator in the
+// default Language, see Language.RegisterFallibleOperator.
+func RegisterFallibleOperator(opToken string,
+	precedence int,
+	leftAssociative bool,
+	evaluer FallibleEvaluer,
+	options ...FunctionOption) error {
+	return defaultLanguage.RegisterFallibleOperator(opToken, precedence, leftAssociative, evaluer, options...)
+}
+
+func MustRegisterOperator(opToken string,
+	precedence int,
+	leftAssociative bool,
+	evaluer NEvaluer,
+	options ...FunctionOption) {
+	defaultLanguage.MustRegisterOperator(opToken, precedence, leftAssociative, evaluer, options...)
+}
+
+func MustRegisterFallibleOperator(opToken string,
+	precedence int,
+	leftAssociative bool,
+	evaluer FallibleEvaluer,
+	options ...FunctionOption) {
+	defaultLanguage.MustRegisterFallibleOperator(opToken, precedence, leftAssociative, evaluer, options...)
+}
+
+// RegisterPrefixOperator registers a new prefix unary operator in
+// the default Language, see Language.RegisterPrefixOperator.
+func RegisterPrefixOperator(opToken string,
+	precedence int,
+	evaluer NEvaluer,
+	options ...FunctionOption) error {
+	return defaultLanguage.RegisterPrefixOperator(opToken, precedence, evaluer, options...)
+}
+
+func MustRegisterPrefixOperator(opToken string,
+	precedence int,
+	evaluer NEvaluer,
+	options ...FunctionOption) {
+	defaultLanguage.MustRegisterPrefixOperator(opToken, precedence, evaluer, options...)
+}
+
+// LookupFunction returns all the overloads of a function of the
+// default Language, see Language.LookupFunction.
+func LookupFunction(name string) []FunctionInfo {
+	return defaultLanguage.LookupFunction(name)
+}
+
+// LookupOperator returns a binary operator of the default Language.
+func LookupOperator(opToken string) (OperatorInfo, bool) {
+	return defaultLanguage.LookupOperator(opToken)
+}
+
+// LookupPrefixOperator returns a prefix operator of the default
+// Language.
+func LookupPrefixOperator(opToken string) (OperatorInfo, bool) {
+	return defaultLanguage.LookupPrefixOperator(opToken)
+}
+
+// UnregisterFunction removes a function from the default Language,
+// see Language.UnregisterFunction.
+func UnregisterFunction(name string) bool {
+	return defaultLanguage.UnregisterFunction(name)
+}
+
+// UnregisterOperator removes a binary operator from the default
+// Language, see Language.UnregisterOperator.
+func UnregisterOperator(opToken string) bool {
+	return defaultLanguage.UnregisterOperator(opToken)
+}
+
+// UnregisterPrefixOperator removes a prefix operator from the default
+// Language, see Language.UnregisterPrefixOperator.
+func UnregisterPrefixOperator(opToken string) bool {
+	return defaultLanguage.UnregisterPrefixOperator(opToken)
+}
@@ -0,0 +1,96 @@
+package meval
+
+import (
+	"math"
+
+	. "gopkg.in/check.v1"
+)
+
+type LanguageSuite struct{}
+
+var _ = Suite(&LanguageSuite{})
+
+func (s *LanguageSuite) TestLanguagesAreIsolated(c *C) {
+	l := NewLanguage()
+	c.Assert(l.RegisterFunction("half", 1, func(a []float64) float64 { return a[0] / 2 }), IsNil)
+	c.Assert(l.RegisterOperator("%", 3, true, func(a []float64) float64 { return math.Mod(a[0], a[1]) }), IsNil)
+
+	e, err := l.Compile("half(7 % 4) + sin(0)")
+	c.Assert(err, IsNil)
+	res, err := e.Eval(nil)
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, 1.5)
+
+	_, err = Compile("half(3)")
+	c.Check(err, Not(IsNil))
+	_, ok := LookupOperator("%")
+	c.Check(ok, Equals, false)
+	c.Check(LookupFunction("half"), IsNil)
+
+	// package level registration does not leak in new Languages
+	c.Assert(RegisterFunction("triple", 1, func(a []float64) float64 { return 3 * a[0] }), IsNil)
+	defer UnregisterFunction("triple")
+	c.Check(NewLanguage().LookupFunction("triple"), IsNil)
+	c.Check(DefaultLanguage().LookupFunction("triple"), HasLen, 1)
+
+	// but a clone of the default Language knows it
+	clone := DefaultLanguage().Clone()
+	c.Check(clone.LookupFunction("triple"), HasLen, 1)
+	c.Check(clone.UnregisterFunction("sin"), Equals, true)
+	c.Check(LookupFunction("sin"), HasLen, 1)
+	_, err = clone.Compile("sin(0)")
+	c.Check(err, Not(IsNil))
+}
+
+func (s *LanguageSuite) TestEmptyLanguage(c *C) {
+	l := NewEmptyLanguage()
+	tests := []CompileError{
+		{"1 + 2", "1:3: Invalid token \"\\+\" found"},
+		{"-2", "1:1: Operator '-' is not yet implemented"},
+		{"2 * 3", "1:3: Got unexpected rune \\*"},
+	}
+	for _, t := range tests {
+		_, err := l.Compile(t.input)
+		c.Check(err, ErrorMatches, t.error, Commentf("input: %s", t.input))
+	}
+
+	e, err := l.Compile("(foo)")
+	c.Assert(err, IsNil)
+	c.Check(Dependencies(e), DeepEquals, []string{"foo"})
+
+	// a restricted dialect with only the needed symbols
+	c.Assert(l.RegisterOperator("+", 2, true, func(a []float64) float64 { return a[0] + a[1] }), IsNil)
+	c.Assert(l.RegisterPrefixOperator("-", 4, func(a []float64) float64 { return -a[0] }), IsNil)
+	c.Assert(l.RegisterVariadicFunction("max", 1, -1, func(a []float64) (float64, error) {
+		return math.Max(a[0], a[len(a)-1]), nil
+	}), IsNil)
+	e, err = l.Compile("max(1 +2, -3) + -4")
+	c.Assert(err, IsNil)
+	res, err := e.Eval(nil)
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, -1.0)
+
+	// '-' is only a prefix operator
+	_, err = l.Compile("1 - 2")
+	c.Check(err, ErrorMatches, "1:3: Operator '-' is not yet implemented")
+}
+
+func (s *LanguageSuite) TestZeroLanguage(c *C) {
+	var l Language
+	e, err := l.Compile("(a)")
+	c.Assert(err, IsNil)
+	c.Check(Dependencies(e), DeepEquals, []string{"a"})
+	_, err = l.Compile("a + 1")
+	c.Check(err, ErrorMatches, "1:3: Invalid token \"\\+\" found")
+
+	c.Assert(l.RegisterOperator("+", 2, true, func(a []float64) float64 { return a[0] + a[1] }), IsNil)
+	e, err = l.Compile("1 + 2")
+	c.Assert(err, IsNil)
+	res, err := e.Eval(nil)
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, 3.0)
+	// the symbols of other zero Languages are not modified
+	var other Language
+	_, err = other.Compile("1 + 2")
+	c.Check(err, Not(IsNil))
+}
@@ -33,19 +33,37 @@ const (
 	TokIdent
 	// TokValue is a a floating number value
 	TokValue
+	// TokLess is a '<'
+	TokLess
+	// TokLessEqual is a '<='
+	TokLessEqual
+	// TokGreater is a '>'
+	TokGreater
+	// TokGreaterEqual is a '>='
+	TokGreaterEqual
+	// TokEqual is a '=='
+	TokEqual
+	// TokNotEqual is a '!='
+	TokNotEqual
+	// TokAnd is a '&&'
+	TokAnd
+	// TokOr is a '||'
+	TokOr
+	// TokNot is a '!'
+	TokNot
 	tokUserStart
 )
 
 // A Token represent a lexed string
-//
-// TODO(tuleu): Maybe improve by giving indexes of the input string,
-// and ref to the input string. Value then should be a function
 type Token struct {
 	// The TokenType
 	Type TokenType
 
 	// The Lexed string
 	Value string
+
+	// The location of Value in the input string
+	Pos Position
 }
 
 // NewToken creates a new Token
@@ -65,15 +83,28 @@ type Lexer struct {
 	action     lActionFn
 	start, pos int
 	width      int
+	// position of start
+	startPos Position
+	// known operator tokens
+	symbols *symbols
 }
 
 // NewLexer instantiates a Lexer from a string
 func NewLexer(input string) *Lexer {
+	return newLexer(input, defaultLanguage.registry.load())
+}
+
+func newLexer(input string, s *symbols) *Lexer {
 	return &Lexer{
-		input:  input,
-		start:  0,
-		pos:    0,
-		width:  0,
+		input:   input,
+		symbols: s,
+		start:   0,
+		pos:     0,
+		width:   0,
+		startPos: Position{
+			Line:   1,
+			Column: 1,
+		},
 		errors: make(chan error, 2),
 		tokens: make(chan Token, 2),
 		action: lexWS,
@@ -141,12 +172,8 @@ func lexNumber(l *Lexer) lActionFn {
 	if l.accept("+-") {
 		hasPM = true
 		if l.accept(numeric) == false {
-			if l.current() == "+" {
-				l.emit(TokPlus)
-			} else {
-				l.emit(TokMinus)
-			}
-			return lexWS
+			// not a number, but an operator starting with a sign
+			return lexOperator
 		}
 		l.backup()
 	}
@@ -194,23 +221,26 @@ func lexOperator(l *Lexer) lActionFn {
 	// This function is tricky. we should accept the largest operator
 	// found, or split it, as '()' should not be considered a single
 	// bad token, but two good
-	var action lActionFn
+	found := false
+	var tType TokenType
 	var savePos int
 	for {
-		if cAction, ok := operatorToken[l.current()]; ok == true {
-			action = cAction
+		if t, ok := l.symbols.tokens[l.current()]; ok == true {
+			found = true
+			tType = t
 			savePos = l.pos
 		}
 
-		if l.accept(opTokenAccept) == false {
+		if l.accept(l.symbols.accept) == false {
 			break
 		}
 	}
-	if action == nil {
+	if found == false {
 		return l.errorf("Invalid token %q found", l.current())
 	}
 	l.pos = savePos
-	return action
+	l.emit(tType)
+	return lexWS
 
 }
 
@@ -240,7 +270,7 @@ func lexWS(l *Lexer) lActionFn {
 		return lexIdentifier
 	}
 
-	if l.accept(opTokenAccept) {
+	if l.accept(l.symbols.accept) {
 		return lexOperator
 	}
 
@@ -253,63 +283,43 @@ var numeric = "0123456789"
 
 var alphabetic = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
-var operatorToken = make(map[string]lActionFn)
-
 var opRegexp = regexp.MustCompile(`^[^a-zA-Z0-9_\s]+$`)
 
-var opTokenAccept string
-
-func registerOpToken(opTok string, t TokenType) error {
+// addToken makes the Lexer emits t for opTok
+func (s *symbols) addToken(opTok string, t TokenType) error {
 	if opRegexp.MatchString(opTok) == false {
 		return fmt.Errorf("Invalid operator syntax %q", opTok)
 	}
 
-	// for each rune in the string, we add it to the opTokenAccept
-	// string if not there
-	for i := 0; i < len(opTok); i++ {
-		//decode by rune
-		ru, width := utf8.DecodeRuneInString(opTok[i:])
-		i += width
-
-		if strings.IndexRune(opTokenAccept, ru) == -1 {
+	// for each rune in the string, we add it to the accept string
+	// if not there
+	for _, ru := range opTok {
+		if strings.IndexRune(s.accept, ru) == -1 {
 			//not in test string
-			opTokenAccept += string(ru)
+			s.accept += string(ru)
 		}
 	}
 
-	operatorToken[opTok] = func(l *Lexer) lActionFn {
-		l.emit(t)
-		return lexWS
-	}
+	s.tokens[opTok] = t
 	return nil
 }
 
-func mustRegisterOpToken(opTok string, t TokenType) {
-	if err := registerOpToken(opTok, t); err != nil {
-		panic("Cannot register operator token : " + err.Error())
-	}
-}
-
-func init() {
-	//Private Token initialization
-	mustRegisterOpToken("+", TokPlus)
-	mustRegisterOpToken("-", TokMinus)
-	mustRegisterOpToken("*", TokMult)
-	mustRegisterOpToken("^", TokPower)
-	mustRegisterOpToken("/", TokDivide)
-	mustRegisterOpToken("(", TokOParen)
-	mustRegisterOpToken(")", TokCParen)
-	mustRegisterOpToken(",", TokComma)
-}
-
 // helpers
 
 func (l *Lexer) current() string {
 	return l.input[l.start:l.pos]
 }
 
+func (l *Lexer) currentPosition() Position {
+	res := l.startPos
+	res.Length = l.pos - l.start
+	return res
+}
+
 func (l *Lexer) emit(t TokenType) {
-	l.tokens <- NewToken(t, l.current())
+	tok := NewToken(t, l.current())
+	tok.Pos = l.currentPosition()
+	l.tokens <- tok
 	l.ignore()
 }
 
@@ -321,7 +331,7 @@ func (l *Lexer) error(err error) lActionFn {
 }
 
 func (l *Lexer) errorf(format string, args ...interface{}) lActionFn {
-	return l.error(fmt.Errorf(format, args...))
+	return l.error(newSyntaxError(l.input, l.currentPosition(), format, args...))
 }
 
 func (l *Lexer) next() rune {
@@ -347,6 +357,7 @@ func (l *Lexer) backup() {
 }*/
 
 func (l *Lexer) ignore() {
+	l.startPos = l.startPos.advance(l.current())
 	l.start = l.pos
 }
 
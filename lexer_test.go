@@ -19,7 +19,8 @@ func CheckAllToken(l *Lexer, tokens []Token, c *C) {
 	for i, t := range tokens {
 		lexed, err := l.Next()
 		c.Assert(err, IsNil, Commentf("[%d:Check '%s']: got error: %s", i, t.Value, err))
-		c.Check(lexed, Equals, t)
+		c.Check(lexed.Type, Equals, t.Type)
+		c.Check(lexed.Value, Equals, t.Value)
 	}
 
 	_, err := l.Next()
@@ -67,7 +68,7 @@ func (s *LexSuite) TestReportBadNumberSyntax(c *C) {
 		if c.Check(err, Not(IsNil)) == false {
 			continue
 		}
-		c.Check(err.Error(), Equals, fmt.Sprintf("Bad number syntax %q", t.error))
+		c.Check(err.Error(), Equals, fmt.Sprintf("1:1: Bad number syntax %q", t.error))
 	}
 }
 
@@ -96,15 +97,48 @@ func (s *LexSuite) TestComplexLex(c *C) {
 	CheckAllToken(NewLexer(toLex), tokens, c)
 }
 
+func (s *LexSuite) TestTokenPositions(c *C) {
+	l := NewLexer("foo +\n\t-2.5*(é)")
+	expected := []Position{
+		{Offset: 0, Line: 1, Column: 1, Length: 3},
+		{Offset: 4, Line: 1, Column: 5, Length: 1},
+		{Offset: 7, Line: 2, Column: 2, Length: 4},
+		{Offset: 11, Line: 2, Column: 6, Length: 1},
+		{Offset: 12, Line: 2, Column: 7, Length: 1},
+	}
+	for _, p := range expected {
+		t, err := l.Next()
+		c.Assert(err, IsNil)
+		c.Check(t.Pos, Equals, p)
+	}
+
+	// 'é' is 2 bytes long, but a single column
+	_, err := l.Next()
+	c.Assert(err, Not(IsNil))
+	perr, ok := err.(*ParseError)
+	c.Assert(ok, Equals, true)
+	c.Check(perr.Pos, Equals, Position{Offset: 13, Line: 2, Column: 8, Length: 0})
+	c.Check(perr.Highlight(), Equals, "\t-2.5*(é)\n\t      ^")
+}
+
+func (s *LexSuite) TestPositionHighlight(c *C) {
+	input := "a + foo(b,\nc) - 2"
+	c.Check(positionAt(input, 4, 3).Highlight(input), Equals, "a + foo(b,\n    ^^^")
+	c.Check(positionAt(input, 14, 1).Highlight(input), Equals, "c) - 2\n   ^")
+	c.Check(positionAt(input, len(input), 0).Highlight(input), Equals, "c) - 2\n      ^")
+}
+
 func (s *LexSuite) TestReportUnknownToken(c *C) {
 	l := NewLexer("@")
 	_, err := l.Next()
 	c.Assert(err, Not(IsNil))
-	c.Check(err.Error(), Equals, "Got unexpected rune @")
+	c.Check(err.Error(), Equals, "1:1: Got unexpected rune @")
 }
 
 func (s *LexSuite) TestShouldForbidInvalidOperatorToken(c *C) {
-	err := registerOpToken("aa", tokUserStart)
+	lang := NewLanguage()
+	add := func(a []float64) float64 { return a[0] + a[1] }
+	err := lang.RegisterOperator("aa", 2, true, add)
 	c.Assert(err, Not(IsNil))
 	c.Check(err.Error(), Equals, "Invalid operator syntax \"aa\"")
 
@@ -112,22 +146,25 @@ func (s *LexSuite) TestShouldForbidInvalidOperatorToken(c *C) {
 	defer func() {
 		if r := recover(); r != nil {
 			hasPanic = true
-			c.Check(r, Equals, "Cannot register operator token : Invalid operator syntax \"aa\"")
+			c.Check(r, Equals, "Cannot register operator aa : Invalid operator syntax \"aa\"")
 		}
 
 		c.Check(hasPanic, Equals, true)
 
 	}()
 
-	mustRegisterOpToken("aa", tokUserStart)
+	lang.MustRegisterOperator("aa", 2, true, add)
 }
 
 func (s *LexSuite) TestReportsInvalidTokenOperator(c *C) {
 	// Adds a special token for @@
-	err := registerOpToken("@@", tokUserStart)
+	lang := NewLanguage()
+	err := lang.RegisterOperator("@@", 2, true, func(a []float64) float64 { return a[0] })
 	c.Assert(err, IsNil, Commentf("Cannot register valid token @@ : %s", err))
+	symbols := lang.registry.load()
+	c.Check(symbols.tokens["@@"], Equals, tokUserStart)
 
-	l := NewLexer("@@ @@@@ @")
+	l := newLexer("@@ @@@@ @", symbols)
 
 	t, err := l.Next()
 	c.Assert(err, IsNil)
@@ -143,6 +180,19 @@ func (s *LexSuite) TestReportsInvalidTokenOperator(c *C) {
 
 	t, err = l.Next()
 	c.Assert(err, Not(IsNil))
-	c.Check(err.Error(), Equals, "Invalid token \"@\" found")
+	c.Check(err.Error(), Equals, "1:9: Invalid token \"@\" found")
 
 }
+
+func (s *LexSuite) TestMultiRuneOperators(c *C) {
+	lang := NewLanguage()
+	for _, op := range []string{"#$", "±∓§"} {
+		err := lang.RegisterOperator(op, 2, true, func(a []float64) float64 { return a[0] - a[1] })
+		c.Assert(err, IsNil)
+		e, err := lang.Compile("1 " + op + " 2")
+		c.Assert(err, IsNil, Commentf("operator %s", op))
+		res, err := e.Eval(nil)
+		c.Assert(err, IsNil)
+		c.Check(res, Equals, -1.0)
+	}
+}
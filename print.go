@@ -0,0 +1,123 @@
+package meval
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// All Expression returned by Compile implement fmt.Stringer. They
+// print in a canonical form, with only the parenthese required by
+// the precedence and associativity of the operators. The result can
+// be compiled back to the same Expression.
+
+func (e *valueExp) String() string {
+	switch {
+	case math.IsNaN(e.value):
+		return "(0/0)"
+	case math.IsInf(e.value, 1):
+		return "(1/0)"
+	case math.IsInf(e.value, -1):
+		return "(-1/0)"
+	}
+	return strconv.FormatFloat(e.value, 'g', -1, 64)
+}
+
+func (e *refExp) String() string {
+	return e.variable
+}
+
+func (e *unaryExp) String() string {
+	operand := formatOperand(e.child, e.precedence, isLeftAssociative(e.child))
+	// avoid to glue two operators together
+	if opRegexp.MatchString(operand[:1]) == true && operand[0] != '(' {
+		return e.name + " " + operand
+	}
+	return e.name + operand
+}
+
+func (e *binaryExp) String() string {
+	return formatBinary(e.name, e.precedence, e.leftAssociative, e.leftChild, e.rightChild)
+}
+
+func (e *lazyBinaryExp) String() string {
+	return formatBinary(e.name, e.precedence, e.leftAssociative, e.leftChild, e.rightChild)
+}
+
+func (e *nExp) String() string {
+	return formatCall(e.name, e.children)
+}
+
+func (e *lazyExp) String() string {
+	return formatCall(e.name, e.children)
+}
+
+func formatCall(name string, args []Expression) string {
+	formatted := make([]string, len(args))
+	for i, a := range args {
+		formatted[i] = format(a)
+	}
+	return name + "(" + strings.Join(formatted, ", ") + ")"
+}
+
+func formatBinary(name string, precedence int, leftAssociative bool, left, right Expression) string {
+	// the left operand needs parenthese if it would not be popped
+	// out by this operator, the right one if it would pop out this
+	// operator.
+	return formatOperand(left, precedence, leftAssociative == false) +
+		" " + name + " " +
+		formatOperand(right, precedence, isLeftAssociative(right))
+}
+
+// formatOperand formats e as an operand of an operator with the given
+// precedence. If sameNeedsParenthese is true, an operand with the same
+// precedence is enclosed in parenthese.
+func formatOperand(e Expression, precedence int, sameNeedsParenthese bool) string {
+	res := format(e)
+	p, isOperator := operatorPrecedence(e)
+	if isOperator == false {
+		return res
+	}
+	if p < precedence || (p == precedence && sameNeedsParenthese == true) {
+		return "(" + res + ")"
+	}
+	return res
+}
+
+// operatorPrecedence returns the precedence of e if it is parsed as
+// an operator. Negative literals are parsed as a prefix '-', other
+// non-finite ones are already enclosed in parenthese.
+func operatorPrecedence(e Expression) (int, bool) {
+	switch n := e.(type) {
+	case *unaryExp:
+		return n.precedence, true
+	case *binaryExp:
+		return n.precedence, true
+	case *lazyBinaryExp:
+		return n.precedence, true
+	case *valueExp:
+		if math.IsInf(n.value, 0) == false && math.Signbit(n.value) == true {
+			return prefixPrecedence, true
+		}
+	}
+	return 0, false
+}
+
+func isLeftAssociative(e Expression) bool {
+	switch n := e.(type) {
+	case *binaryExp:
+		return n.leftAssociative
+	case *lazyBinaryExp:
+		return n.leftAssociative
+	}
+	return false
+}
+
+func format(e Expression) string {
+	if s, ok := e.(interface {
+		String() string
+	}); ok == true {
+		return s.String()
+	}
+	return "?"
+}
@@ -0,0 +1,103 @@
+package meval
+
+import (
+	"fmt"
+	"math"
+
+	. "gopkg.in/check.v1"
+)
+
+type PrintSuite struct{}
+
+var _ = Suite(&PrintSuite{})
+
+func (s *PrintSuite) TestCanonicalForm(c *C) {
+	tests := []struct {
+		input, output string
+	}{
+		{"1+2", "1 + 2"},
+		{"(1 + 2) * 3", "(1 + 2) * 3"},
+		{"1 + (2 * 3)", "1 + 2 * 3"},
+		{"(a - b) - c", "a - b - c"},
+		{"a - (b - c)", "a - (b - c)"},
+		{"a / (b * c)", "a / (b * c)"},
+		{"(a ^ b) ^ c", "(a ^ b) ^ c"},
+		{"a ^ (b ^ c)", "a ^ b ^ c"},
+		{"-2^2", "-2 ^ 2"},
+		{"(-2)^2", "(-2) ^ 2"},
+		{"2^-1", "2 ^ -1"},
+		{"-(a + b)", "-(a + b)"},
+		{"- -a", "- -a"},
+		{"-(-3)", "- -3"},
+		{"2 * -foo", "2 * -foo"},
+		{"+3", "+3"},
+		{"!(a && b) || c", "!(a && b) || c"},
+		{"a || (b && c)", "a || b && c"},
+		{"(a || b) && c", "(a || b) && c"},
+		{"(a < b) == (c > d)", "a < b == (c > d)"},
+		{"a < (b == c)", "a < (b == c)"},
+		{"atan2( 1,-x )", "atan2(1, -x)"},
+		{"if(a>0,ln(a),max(1,2,3))", "if(a > 0, ln(a), max(1, 2, 3))"},
+		{"pi()", "pi()"},
+		{"1.50", "1.5"},
+		{"1e21 + 0.001", "1e+21 + 0.001"},
+	}
+
+	for _, t := range tests {
+		e, err := Compile(t.input)
+		c.Assert(err, IsNil, Commentf("%s: %s", t.input, err))
+		c.Check(fmt.Sprint(e), Equals, t.output, Commentf("input: %s", t.input))
+
+		// it round trips
+		ee, err := Compile(format(e))
+		c.Assert(err, IsNil, Commentf("%s: %s", format(e), err))
+		c.Check(format(ee), Equals, t.output)
+	}
+}
+
+func (s *PrintSuite) TestRoundTripEvaluation(c *C) {
+	ctx := NewMapContext()
+	ctx.Add("a", NewValue(2))
+	ctx.Add("b", NewValue(-3))
+	inputs := []string{
+		"a - b - a",
+		"a - (b - a)",
+		"-a ^ 2",
+		"(-a) ^ 2",
+		"a ^ -b ^ 2",
+		"2 ^ 3 ^ 2",
+		"!a + b",
+		"!(a + b)",
+		"a * -b / (a - b) ^ -1",
+	}
+	for _, input := range inputs {
+		e, err := Compile(input)
+		c.Assert(err, IsNil)
+		ee, err := Compile(format(e))
+		c.Assert(err, IsNil, Commentf("%s: %s", format(e), err))
+
+		expected, err := e.Eval(ctx)
+		c.Assert(err, IsNil)
+		res, err := ee.Eval(ctx)
+		c.Assert(err, IsNil)
+		c.Check(res, Equals, expected, Commentf("%s printed as %s", input, format(e)))
+	}
+}
+
+func (s *PrintSuite) TestPrintsRewrittenValues(c *C) {
+	e, err := Compile("a ^ 2 + b")
+	c.Assert(err, IsNil)
+
+	values := map[string]float64{
+		"a": -3,
+		"b": math.Inf(-1),
+	}
+	e = Rewrite(e, func(e Expression) Expression {
+		if ref, ok := e.(ReferenceNode); ok == true {
+			return NewValue(values[ref.Variable()])
+		}
+		return e
+	})
+	c.Check(format(e), Equals, "(-3) ^ 2 + (-1/0)")
+	c.Check(format(NewValue(math.NaN())), Equals, "(0/0)")
+}
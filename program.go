@@ -0,0 +1,379 @@
+package meval
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+)
+
+// A Program is an Expression compiled into a tree of Go closures,
+// for repeated evaluations. Its variables are resolved to slots, so
+// they are passed by position to Eval, and the evaluation does not
+// allocate.
+//
+// The slice of arguments passed to a function evaluer is reused by
+// later evaluations, so it must not be retained. Calls to user lazy
+// functions are evaluated with Expression.Eval, and still
+// allocate. A Program is safe for concurrent use.
+type Program struct {
+	variables []string
+	root      instr
+	// inlined variables of the Context, evaluated at most once per
+	// evaluation
+	inlined []instr
+	// size of the scratch buffer holding the arguments of calls
+	scratch int
+	// pool of *machine
+	machines sync.Pool
+}
+
+// machine is the state of an evaluation of a Program
+type machine struct {
+	slots   []float64
+	scratch []float64
+	// values of the inlined variables, valid if computed during the
+	// current generation
+	inlined    []float64
+	computed   []uint64
+	generation uint64
+	p          *Program
+}
+
+// instr evaluates a node of a Program
+type instr func(m *machine) (float64, error)
+
+// NewProgram compiles e into a Program, where the given variables are
+// resolved to slots. Other variables are looked up in c, that can be
+// nil, and their definitions are inlined: they are looked up once,
+// when the Program is built, and each of them is evaluated at most
+// once per evaluation, unless it calls an Impure function. Variables
+// of a CachedContext that do not depend on the slots are evaluated by
+// the CachedContext, so their memoized value is used. As with
+// Expression.Eval, references that cannot be resolved or are cyclic
+// only fail when evaluated.
+func NewProgram(e Expression, c Context, variables ...string) (*Program, error) {
+	p := &Program{variables: append([]string(nil), variables...)}
+	b := &programBuilder{
+		p:       p,
+		index:   make(map[string]int, len(variables)),
+		inlined: make(map[variableKey]int),
+	}
+	for i, v := range variables {
+		if _, ok := b.index[v]; ok == true {
+			return nil, fmt.Errorf("Duplicated variable '%s'", v)
+		}
+		b.index[v] = i
+	}
+	p.root = b.build(e, c)
+	p.machines.New = func() interface{} {
+		return &machine{
+			slots:    make([]float64, len(p.variables)),
+			scratch:  make([]float64, p.scratch),
+			inlined:  make([]float64, len(p.inlined)),
+			computed: make([]uint64, len(p.inlined)),
+			p:        p,
+		}
+	}
+	return p, nil
+}
+
+// CompileProgram compiles input with the default Language, and
+// returns it as a Program, see Language.CompileProgram.
+func CompileProgram(input string, variables ...string) (*Program, error) {
+	return defaultLanguage.CompileProgram(input, variables...)
+}
+
+// CompileProgram compiles input, and returns it as a Program where
+// the given variables are resolved to slots. Any other variable
+// fails to evaluate with a *NoContextError.
+func (l *Language) CompileProgram(input string, variables ...string) (*Program, error) {
+	e, err := l.Compile(input)
+	if err != nil {
+		return nil, err
+	}
+	return NewProgram(e, nil, variables...)
+}
+
+// Variables returns the variables of the Program, in slot order.
+func (p *Program) Variables() []string {
+	return append([]string(nil), p.variables...)
+}
+
+// Eval evaluates the Program, values holds the value of each of its
+// variables, in slot order.
+func (p *Program) Eval(values []float64) (float64, error) {
+	if len(values) != len(p.variables) {
+		return math.NaN(), fmt.Errorf("Program expects %d values, got %d", len(p.variables), len(values))
+	}
+	m := p.machines.Get().(*machine)
+	// values are copied, so they do not escape to the heap
+	copy(m.slots, values)
+	m.generation++
+	res, err := p.root(m)
+	p.machines.Put(m)
+	return res, err
+}
+
+type programBuilder struct {
+	p     *Program
+	index map[string]int
+	// index of the variables already inlined
+	inlined map[variableKey]int
+	// variables being inlined, to detect cycles
+	path []variableKey
+	// true if the node being built calls an Impure function
+	impure bool
+}
+
+// variableKey identifies a variable of a Context. ctx is nil if the
+// Context is not a pointer, so the variable is not shared: a value
+// could hold a map in an interface field, and fail to hash.
+type variableKey struct {
+	ctx  Context
+	name string
+}
+
+func keyOf(c Context, name string) variableKey {
+	if reflect.TypeOf(c).Kind() != reflect.Ptr {
+		return variableKey{name: name}
+	}
+	return variableKey{ctx: c, name: name}
+}
+
+func failing(err error) instr {
+	return func(*machine) (float64, error) {
+		return math.NaN(), err
+	}
+}
+
+func (b *programBuilder) build(e Expression, c Context) instr {
+	switch n := e.(type) {
+	case *valueExp:
+		v := n.value
+		return func(*machine) (float64, error) {
+			return v, nil
+		}
+	case *refExp:
+		return b.buildRef(n, c)
+	case *cachedExp:
+		return b.buildCached(n)
+	case *unaryExp:
+		return b.buildUnary(n, c)
+	case *binaryExp:
+		return b.buildBinary(n, c)
+	case *nExp:
+		return b.buildCall(n, c)
+	case *lazyExp:
+		if n.builtin == true && n.name == "if" {
+			cond, then, otherwise := b.build(n.children[0], c), b.build(n.children[1], c), b.build(n.children[2], c)
+			return func(m *machine) (float64, error) {
+				v, err := cond(m)
+				if err != nil {
+					return math.NaN(), err
+				}
+				if v != 0 {
+					return then(m)
+				}
+				return otherwise(m)
+			}
+		}
+	case *lazyBinaryExp:
+		if n.builtin == true && (n.name == "&&" || n.name == "||") {
+			return b.buildLogical(n, c)
+		}
+	}
+	b.impure = b.impure || IsDeterministic(e, c) == false
+	return fallback(e, c)
+}
+
+func (b *programBuilder) buildRef(e *refExp, c Context) instr {
+	name := e.variable
+	if i, ok := b.index[name]; ok == true {
+		return func(m *machine) (float64, error) {
+			return m.slots[i], nil
+		}
+	}
+	if c == nil {
+		return failing(&NoContextError{Name: name})
+	}
+
+	key := keyOf(c, name)
+	shared := key.ctx != nil
+	for i, k := range b.path {
+		if k == key {
+			cycle := []string{}
+			for _, k := range b.path[i:] {
+				cycle = append(cycle, k.name)
+			}
+			cycle = append(cycle, name)
+			return failing(wrapEvalError(name, &CyclicDependencyError{Cycle: cycle}))
+		}
+	}
+
+	i, memoize := b.inlined[key]
+	if memoize == false {
+		expr, err := c.GetExpression(name)
+		if err != nil {
+			return failing(err)
+		}
+		// the definition is built in its own inlined slot
+		impure := b.impure
+		b.impure = false
+		b.path = append(b.path, key)
+		body := b.build(expr, c)
+		b.path = b.path[:len(b.path)-1]
+		i = len(b.p.inlined)
+		b.p.inlined = append(b.p.inlined, body)
+		// impure definitions are evaluated at each reference
+		if b.impure == false && shared == true {
+			b.inlined[key] = i
+			memoize = true
+		}
+		b.impure = impure || b.impure
+	}
+
+	p := b.p
+	return func(m *machine) (float64, error) {
+		if memoize == true && m.computed[i] == m.generation {
+			return m.inlined[i], nil
+		}
+		v, err := p.inlined[i](m)
+		if err != nil {
+			return math.NaN(), wrapEvalError(name, err)
+		}
+		m.inlined[i], m.computed[i] = v, m.generation
+		return v, nil
+	}
+}
+
+// buildCached builds a variable of a CachedContext. If it does not
+// depend on the slots, its memoized value is used.
+func (b *programBuilder) buildCached(e *cachedExp) instr {
+	for _, d := range TransitiveDependencies(e.expr, e.ctx) {
+		if _, ok := b.index[d]; ok == true {
+			return b.build(e.expr, e.ctx)
+		}
+	}
+	b.impure = b.impure || IsDeterministic(e.expr, e.ctx) == false
+	return func(*machine) (float64, error) {
+		return e.Eval(nil)
+	}
+}
+
+func (b *programBuilder) buildUnary(e *unaryExp, c Context) instr {
+	b.impure = b.impure || e.impure
+	child, evaluer := b.build(e.child, c), e.evaluer
+	if e.builtin == true && e.name == "-" {
+		return func(m *machine) (float64, error) {
+			v, err := child(m)
+			return -v, err
+		}
+	}
+	return func(m *machine) (float64, error) {
+		v, err := child(m)
+		if err != nil {
+			return math.NaN(), err
+		}
+		return evaluer(v)
+	}
+}
+
+func (b *programBuilder) buildBinary(e *binaryExp, c Context) instr {
+	b.impure = b.impure || e.impure
+	left, right := b.build(e.leftChild, c), b.build(e.rightChild, c)
+	operands := func(m *machine) (float64, float64, error) {
+		a, err := left(m)
+		if err != nil {
+			return math.NaN(), math.NaN(), err
+		}
+		v, err := right(m)
+		return a, v, err
+	}
+	// the most common operators avoid a call to their evaluer
+	if op := arithmetic(e); op != nil {
+		return func(m *machine) (float64, error) {
+			a, v, err := operands(m)
+			if err != nil {
+				return math.NaN(), err
+			}
+			return op(a, v), nil
+		}
+	}
+	evaluer := e.evaluer
+	return func(m *machine) (float64, error) {
+		a, v, err := operands(m)
+		if err != nil {
+			return math.NaN(), err
+		}
+		return evaluer(a, v)
+	}
+}
+
+func (b *programBuilder) buildCall(e *nExp, c Context) instr {
+	b.impure = b.impure || e.impure
+	children := make([]instr, len(e.children))
+	for i, child := range e.children {
+		children[i] = b.build(child, c)
+	}
+	// each call has its own region of the scratch buffer for its
+	// arguments
+	start, end := b.p.scratch, b.p.scratch+len(children)
+	b.p.scratch = end
+	evaluer := e.evaluer
+	return func(m *machine) (float64, error) {
+		args := m.scratch[start:end:end]
+		for i, child := range children {
+			var err error
+			if args[i], err = child(m); err != nil {
+				return math.NaN(), err
+			}
+		}
+		return evaluer(args)
+	}
+}
+
+func (b *programBuilder) buildLogical(e *lazyBinaryExp, c Context) instr {
+	left, right := b.build(e.leftChild, c), b.build(e.rightChild, c)
+	and := e.name == "&&"
+	return func(m *machine) (float64, error) {
+		v, err := left(m)
+		if err != nil {
+			return math.NaN(), err
+		}
+		// false for '&&', or true for '||', short-circuits
+		if (v != 0) != and {
+			return boolToFloat(!and), nil
+		}
+		if v, err = right(m); err != nil {
+			return math.NaN(), err
+		}
+		return boolToFloat(v != 0), nil
+	}
+}
+
+// fallback evaluates e with Expression.Eval, within a Context holding
+// the values of the slots.
+func fallback(e Expression, c Context) instr {
+	return func(m *machine) (float64, error) {
+		return e.Eval(&programContext{m: m, ctx: c})
+	}
+}
+
+// programContext is the Context of a fallback evaluation
+type programContext struct {
+	m   *machine
+	ctx Context
+}
+
+func (c *programContext) GetExpression(name string) (Expression, error) {
+	for i, v := range c.m.p.variables {
+		if v == name {
+			return &valueExp{value: c.m.slots[i]}, nil
+		}
+	}
+	if c.ctx == nil {
+		return nil, &NoContextError{Name: name}
+	}
+	return c.ctx.GetExpression(name)
+}
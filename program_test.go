@@ -0,0 +1,278 @@
+package meval
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type ProgramSuite struct{}
+
+var _ = Suite(&ProgramSuite{})
+
+// controlLaw is a typical expression evaluated in a control loop
+const controlLaw = "if(abs > 1, max(-limit, min(limit, kp * err + ki * integral)), kp * err) + sin(2 * pi() * t) * 0.1"
+
+func (s *ProgramSuite) TestMatchesEval(c *C) {
+	c.Assert(RegisterLazyFunction("orZero", 1, func(args []Expression, ctx Context) (float64, error) {
+		v, err := args[0].Eval(ctx)
+		if err != nil {
+			return 0, nil
+		}
+		return v, nil
+	}), IsNil)
+	defer UnregisterFunction("orZero")
+
+	inputs := []string{
+		"x + y * 2 - x / y",
+		"-x ^ 2 + +y",
+		"!(x > y) + (x <= y) * 3",
+		"x && y || 0 && z",
+		"x > 0 && y < 0 || x != y",
+		"if(x > y, sin(x), cos(y)) + atan2(x, y)",
+		"sum(x, y, 2 * x, 4) + min(x) + max(x, y, z)",
+		"orZero(z) + orZero(x * y)",
+		controlLaw,
+	}
+	variables := []string{"x", "y", "kp", "ki", "limit", "err", "integral", "abs", "t"}
+	values := []float64{1.5, -2, 0.8, 0.1, 2, 3, 0.5, 2, 0.25}
+	ctx := NewMapContext()
+	for i, v := range variables {
+		ctx.Add(v, NewValue(values[i]))
+	}
+	for _, input := range inputs {
+		e, err := Compile(input)
+		c.Assert(err, IsNil)
+		expected, expectedErr := e.Eval(ctx)
+		p, err := NewProgram(e, ctx, variables...)
+		c.Assert(err, IsNil)
+		res, err := p.Eval(values)
+		if expectedErr != nil {
+			c.Check(err, ErrorMatches, expectedErr.Error(), Commentf("input: %s", input))
+			continue
+		}
+		c.Assert(err, IsNil, Commentf("input: %s", input))
+		c.Check(res, Equals, expected, Commentf("input: %s", input))
+	}
+
+	p, err := CompileProgram("x + y", "x", "y")
+	c.Assert(err, IsNil)
+	c.Check(p.Variables(), DeepEquals, []string{"x", "y"})
+	_, err = p.Eval([]float64{1})
+	c.Check(err, ErrorMatches, "Program expects 2 values, got 1")
+	_, err = CompileProgram("x + y", "x", "y", "x")
+	c.Check(err, ErrorMatches, "Duplicated variable 'x'")
+}
+
+func (s *ProgramSuite) TestInlinesContext(c *C) {
+	ctx := NewMapContext()
+	c.Assert(ctx.CompileAndAdd("gain", "2 * k"), IsNil)
+	c.Assert(ctx.CompileAndAdd("k", "3"), IsNil)
+	c.Assert(ctx.CompileAndAdd("loop", "1 + loop"), IsNil)
+	c.Assert(ctx.CompileAndAdd("broken", "missing * 2"), IsNil)
+
+	tests := []struct {
+		input  string
+		result float64
+		error  string
+	}{
+		{"gain * x", 12, ""},
+		{"if(x > 0, k, loop)", 3, ""},
+		{"if(x < 0, k, loop)", math.NaN(), "in loop -> loop: Got cyclic dependency loop -> loop"},
+		{"x + broken", math.NaN(), "in broken: Could not find 'missing' in MapContext"},
+		{"x + y", math.NaN(), "Could not find 'y' in MapContext"},
+	}
+	for _, t := range tests {
+		e, err := Compile(t.input)
+		c.Assert(err, IsNil)
+		p, err := NewProgram(e, ctx, "x", "k")
+		c.Assert(err, IsNil)
+		res, err := p.Eval([]float64{2, 3})
+		if len(t.error) > 0 {
+			c.Check(err, ErrorMatches, t.error, Commentf("input: %s", t.input))
+			continue
+		}
+		c.Assert(err, IsNil, Commentf("input: %s", t.input))
+		c.Check(res, Equals, t.result, Commentf("input: %s", t.input))
+	}
+
+	// slots take precedence over the Context, and definitions are
+	// looked up once
+	e, err := Compile("gain")
+	c.Assert(err, IsNil)
+	p, err := NewProgram(e, ctx, "k")
+	c.Assert(err, IsNil)
+	c.Assert(ctx.CompileAndAdd("gain", "0"), IsNil)
+	res, err := p.Eval([]float64{5})
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, 10.0)
+
+	p, err = CompileProgram("x * y", "x")
+	c.Assert(err, IsNil)
+	_, err = p.Eval([]float64{1})
+	c.Check(err, ErrorMatches, "'y' referenced, but no Context providen")
+}
+
+func (s *ProgramSuite) TestDoesNotAllocate(c *C) {
+	p, err := CompileProgram(controlLaw, "kp", "ki", "limit", "err", "integral", "abs", "t")
+	c.Assert(err, IsNil)
+	values := []float64{0.8, 0.1, 2, 3, 0.5, 2, 0.25}
+	allocs := testing.AllocsPerRun(100, func() {
+		p.Eval(values)
+	})
+	c.Check(allocs, Equals, 0.0)
+}
+
+func (s *ProgramSuite) TestConcurrentEvaluations(c *C) {
+	p, err := CompileProgram("max(x, 2 * x, sum(x, x, x))", "x")
+	c.Assert(err, IsNil)
+	var wg sync.WaitGroup
+	results := make([]float64, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				results[i], _ = p.Eval([]float64{float64(i)})
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, r := range results {
+		c.Check(r, Equals, 3*float64(i))
+	}
+}
+
+func (s *ProgramSuite) BenchmarkEval(c *C) {
+	e, err := Compile(controlLaw)
+	c.Assert(err, IsNil)
+	ctx := NewMapContext()
+	variables := []string{"kp", "ki", "limit", "err", "integral", "abs", "t"}
+	for i, v := range []float64{0.8, 0.1, 2, 3, 0.5, 2, 0.25} {
+		ctx.Add(variables[i], NewValue(v))
+	}
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		e.Eval(ctx)
+	}
+}
+
+func (s *ProgramSuite) BenchmarkProgram(c *C) {
+	p, err := CompileProgram(controlLaw, "kp", "ki", "limit", "err", "integral", "abs", "t")
+	c.Assert(err, IsNil)
+	values := []float64{0.8, 0.1, 2, 3, 0.5, 2, 0.25}
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		p.Eval(values)
+	}
+}
+
+func (s *ProgramSuite) TestSharedVariablesAreEvaluatedOnce(c *C) {
+	calls := 0
+	c.Assert(RegisterFunction("counted", 1, func(a []float64) float64 {
+		calls++
+		return a[0]
+	}), IsNil)
+	defer UnregisterFunction("counted")
+
+	// each level references the previous one twice, inlining them
+	// would be exponential
+	chain := func(ctx interface {
+		CompileAndAdd(string, string) error
+	}, first string) {
+		c.Assert(ctx.CompileAndAdd("x0", first), IsNil)
+		for i := 1; i <= 22; i++ {
+			c.Assert(ctx.CompileAndAdd(fmt.Sprintf("x%d", i), fmt.Sprintf("x%d + x%d", i-1, i-1)), IsNil)
+		}
+	}
+	e, err := Compile("x22 + x21")
+	c.Assert(err, IsNil)
+
+	ctx := NewMapContext()
+	chain(ctx, "counted(a)")
+	p, err := NewProgram(e, ctx, "a")
+	c.Assert(err, IsNil)
+	for _, a := range []float64{1, 2} {
+		res, err := p.Eval([]float64{a})
+		c.Assert(err, IsNil)
+		c.Check(res, Equals, a*(1<<22+1<<21))
+	}
+	c.Check(calls, Equals, 2)
+
+	// the memoized values of a CachedContext are used
+	calls = 0
+	cached := NewCachedContext()
+	chain(cached, "counted(3)")
+	p, err = NewProgram(e, cached)
+	c.Assert(err, IsNil)
+	for i := 0; i < 2; i++ {
+		res, err := p.Eval(nil)
+		c.Assert(err, IsNil)
+		c.Check(res, Equals, 3.0*(1<<22+1<<21))
+	}
+	c.Check(calls, Equals, 1)
+
+	// unless they depend on the slots
+	calls = 0
+	cached = NewCachedContext()
+	chain(cached, "counted(a)")
+	p, err = NewProgram(e, cached, "a")
+	c.Assert(err, IsNil)
+	res, err := p.Eval([]float64{1})
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, 1.0*(1<<22+1<<21))
+	c.Check(calls, Equals, 1)
+
+	// impure variables are evaluated at each reference
+	ctx = NewMapContext()
+	c.Assert(ctx.CompileAndAdd("noise", "rand()"), IsNil)
+	e, err = Compile("noise - noise")
+	c.Assert(err, IsNil)
+	p, err = NewProgram(e, ctx)
+	c.Assert(err, IsNil)
+	res, err = p.Eval(nil)
+	c.Assert(err, IsNil)
+	c.Check(res, Not(Equals), 0.0)
+}
+
+// valueContext is a Context passed by value, that cannot be hashed
+// as it holds a map
+type valueContext struct {
+	inner interface{}
+}
+
+type expressionMap struct {
+	exprs map[string]Expression
+}
+
+func (c valueContext) GetExpression(name string) (Expression, error) {
+	e, ok := c.inner.(expressionMap).exprs[name]
+	if ok == false {
+		return nil, &UndefinedVariableError{Name: name, Context: "valueContext"}
+	}
+	return e, nil
+}
+
+func newValueContext(c *C, defs map[string]string) valueContext {
+	exprs := make(map[string]Expression, len(defs))
+	for name, input := range defs {
+		e, err := Compile(input)
+		c.Assert(err, IsNil)
+		exprs[name] = e
+	}
+	return valueContext{inner: expressionMap{exprs: exprs}}
+}
+
+func (s *ProgramSuite) TestValueContext(c *C) {
+	ctx := newValueContext(c, map[string]string{"a": "2 * x", "b": "a + a"})
+	e, err := Compile("b + a")
+	c.Assert(err, IsNil)
+	p, err := NewProgram(e, ctx, "x")
+	c.Assert(err, IsNil)
+	res, err := p.Eval([]float64{3})
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, 18.0)
+}
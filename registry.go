@@ -0,0 +1,271 @@
+package meval
+
+import (
+	"sort"
+	"sync"
+)
+
+// symbols holds the tables used by the Lexer and the parser. Once
+// published by a registry, a symbols is never modified, so it can be
+// read without locking.
+type symbols struct {
+	// TokenType of each operator token
+	tokens map[string]TokenType
+	// all the runes found in operator tokens
+	accept string
+	// TokenType of the next user operator token
+	nextUserToken TokenType
+
+	operators       map[TokenType]operator
+	prefixOperators map[TokenType]operator
+	// all the overloads of a function name
+	functions map[string][]function
+}
+
+// newSymbols returns symbols that only knows parenthese and comma
+// tokens.
+func newSymbols() *symbols {
+	return &symbols{
+		tokens: map[string]TokenType{
+			"(": TokOParen,
+			")": TokCParen,
+			",": TokComma,
+		},
+		accept:          "(),",
+		nextUserToken:   tokUserStart,
+		operators:       make(map[TokenType]operator),
+		prefixOperators: make(map[TokenType]operator),
+		functions:       make(map[string][]function),
+	}
+}
+
+// clone returns a copy of s that can be modified. Overload slices are
+// shared, they must be copied before being modified.
+func (s *symbols) clone() *symbols {
+	res := &symbols{
+		tokens:          make(map[string]TokenType, len(s.tokens)),
+		accept:          s.accept,
+		nextUserToken:   s.nextUserToken,
+		operators:       make(map[TokenType]operator, len(s.operators)),
+		prefixOperators: make(map[TokenType]operator, len(s.prefixOperators)),
+		functions:       make(map[string][]function, len(s.functions)),
+	}
+	for k, v := range s.tokens {
+		res.tokens[k] = v
+	}
+	for k, v := range s.operators {
+		res.operators[k] = v
+	}
+	for k, v := range s.prefixOperators {
+		res.prefixOperators[k] = v
+	}
+	for k, v := range s.functions {
+		res.functions[k] = v
+	}
+	return res
+}
+
+// registry publishes the symbols used to compile expressions. Each
+// modification is made on a copy, so registration can happen while
+// other goroutines compile, each compilation seeing a consistent set
+// of symbols.
+type registry struct {
+	mx      sync.RWMutex
+	symbols *symbols
+}
+
+// noSymbols are the symbols of a zero registry
+var noSymbols = newSymbols()
+
+// load returns the current symbols, that must not be modified.
+func (r *registry) load() *symbols {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return r.current()
+}
+
+func (r *registry) current() *symbols {
+	if r.symbols == nil {
+		return noSymbols
+	}
+	return r.symbols
+}
+
+// update modifies a copy of the current symbols with f, and publishes
+// it if f does not fail.
+func (r *registry) update(f func(s *symbols) error) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	s := r.current().clone()
+	if err := f(s); err != nil {
+		return err
+	}
+	r.symbols = s
+	return nil
+}
+
+// overlaps returns true if a call could not choose between f and
+// o. A variadic function could overload a fixed one with the same
+// number of arguments, as the fixed one is preferred.
+func (f function) overlaps(o function) bool {
+	if f.variadic() != o.variadic() {
+		return false
+	}
+	return f.accepts(o.minCard) == true || o.accepts(f.minCard) == true
+}
+
+// addFunction adds a new overload for name, or fails with a
+// *ConflictError if it overlaps an existing one.
+func (s *symbols) addFunction(name string, f function) error {
+	overloads := s.functions[name]
+	for _, o := range overloads {
+		if o.overlaps(f) == true {
+			return &ConflictError{Kind: "function", Name: name + "()"}
+		}
+	}
+	s.functions[name] = append(append([]function(nil), overloads...), f)
+	return nil
+}
+
+func (s *symbols) addOperator(t TokenType, op operator) error {
+	if _, ok := s.operators[t]; ok == true {
+		return &ConflictError{Kind: "operator", Name: op.name}
+	}
+	s.operators[t] = op
+	return nil
+}
+
+func (s *symbols) addPrefixOperator(t TokenType, op operator) error {
+	if _, ok := s.prefixOperators[t]; ok == true {
+		return &ConflictError{Kind: "prefix operator", Name: op.name}
+	}
+	s.prefixOperators[t] = op
+	return nil
+}
+
+// userTokenType returns the TokenType associated with opToken,
+// registering a new one if the token is not yet known by the Lexer.
+func (s *symbols) userTokenType(opToken string) (TokenType, error) {
+	if t, ok := s.tokens[opToken]; ok == true {
+		return t, nil
+	}
+	if err := s.addToken(opToken, s.nextUserToken); err != nil {
+		return s.nextUserToken, err
+	}
+	s.nextUserToken++
+	return s.nextUserToken - 1, nil
+}
+
+// FunctionInfo describes an overload of a registered function.
+type FunctionInfo struct {
+	Name string
+	// accepted number of arguments, a negative MaxArgs means that
+	// there is no upper bound.
+	MinArgs, MaxArgs int
+	// true if the function receives its arguments unevaluated
+	Lazy bool
+	// true if the function was registered with the Impure option
+	Impure bool
+}
+
+// OperatorInfo describes a registered operator.
+type OperatorInfo struct {
+	Token           string
+	Precedence      int
+	LeftAssociative bool
+	// true if the operator was registered with the Impure option
+	Impure bool
+}
+
+// LookupFunction returns all the overloads of a registered function,
+// ordered by number of arguments, or nil if name is not registered.
+func (l *Language) LookupFunction(name string) []FunctionInfo {
+	return l.registry.load().lookupFunction(name)
+}
+
+// LookupOperator returns the binary operator registered for opToken.
+func (l *Language) LookupOperator(opToken string) (OperatorInfo, bool) {
+	s := l.registry.load()
+	return s.lookupOperator(s.operators, opToken)
+}
+
+// LookupPrefixOperator returns the prefix operator registered for
+// opToken.
+func (l *Language) LookupPrefixOperator(opToken string) (OperatorInfo, bool) {
+	s := l.registry.load()
+	return s.lookupOperator(s.prefixOperators, opToken)
+}
+
+func (s *symbols) lookupFunction(name string) []FunctionInfo {
+	var res []FunctionInfo
+	for _, f := range s.functions[name] {
+		res = append(res, FunctionInfo{
+			Name:    name,
+			MinArgs: f.minCard,
+			MaxArgs: f.maxCard,
+			Lazy:    f.lazy != nil,
+			Impure:  f.impure,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].MinArgs < res[j].MinArgs })
+	return res
+}
+
+func (s *symbols) lookupOperator(operators map[TokenType]operator, opToken string) (OperatorInfo, bool) {
+	t, ok := s.tokens[opToken]
+	if ok == false {
+		return OperatorInfo{}, false
+	}
+	op, ok := operators[t]
+	if ok == false {
+		return OperatorInfo{}, false
+	}
+	return OperatorInfo{
+		Token:           opToken,
+		Precedence:      op.precedence,
+		LeftAssociative: op.leftAssociative,
+		Impure:          op.impure,
+	}, true
+}
+
+// UnregisterFunction removes all the overloads of a registered
+// function. It returns false if name is not registered. Expressions
+// already compiled are not affected.
+func (l *Language) UnregisterFunction(name string) bool {
+	found := false
+	l.registry.update(func(s *symbols) error {
+		_, found = s.functions[name]
+		delete(s.functions, name)
+		return nil
+	})
+	return found
+}
+
+// UnregisterOperator removes the binary operator registered for
+// opToken. It returns false if there is none. Expressions already
+// compiled are not affected.
+func (l *Language) UnregisterOperator(opToken string) bool {
+	return l.unregisterOperator(func(s *symbols) map[TokenType]operator { return s.operators }, opToken)
+}
+
+// UnregisterPrefixOperator removes the prefix operator registered for
+// opToken. It returns false if there is none. Expressions already
+// compiled are not affected.
+func (l *Language) UnregisterPrefixOperator(opToken string) bool {
+	return l.unregisterOperator(func(s *symbols) map[TokenType]operator { return s.prefixOperators }, opToken)
+}
+
+func (l *Language) unregisterOperator(table func(s *symbols) map[TokenType]operator, opToken string) bool {
+	found := false
+	l.registry.update(func(s *symbols) error {
+		operators := table(s)
+		t, ok := s.tokens[opToken]
+		if ok == false {
+			return nil
+		}
+		_, found = operators[t]
+		delete(operators, t)
+		return nil
+	})
+	return found
+}
@@ -0,0 +1,149 @@
+package meval
+
+// Simplify returns a simplified copy of e, that evaluates to the same
+// value in any Context. e is left untouched.
+//
+// Constant subtrees are folded into a single value, unless they call
+// an Impure function or operator, or their evaluation fails so the
+// error is still reported by Eval. Expression types not returned by
+// Compile are left untouched. A built-in if(), && or || whose
+// condition is constant is replaced by the taken branch when
+// possible. Finally the following identities are applied on the
+// built-in operators:
+//
+//	x + 0, 0 + x, x - 0, x * 1, 1 * x, x / 1, x ^ 1, +x, - -x => x
+//
+// These rules are NaN-safe: they hold when x is NaN or infinite. For
+// this reason 0 * x, x * 0, x - x and x / x are not simplified, as
+// they evaluate to NaN for such x. No rule drops x, so its errors are
+// kept: x ^ 0 is not simplified either. The sign of a zero may however
+// differ, as -0 + 0 evaluates to +0.
+func Simplify(e Expression) Expression {
+	return Rewrite(e, simplifyNode)
+}
+
+// simplifyNode simplifies e, whose children are already simplified
+func simplifyNode(e Expression) Expression {
+	if v, ok := foldConstant(e); ok == true {
+		return v
+	}
+
+	switch n := e.(type) {
+	case *unaryExp:
+		if n.builtin == false {
+			break
+		}
+		if n.name == "+" {
+			return n.child
+		}
+		if inner, ok := n.child.(*unaryExp); ok == true && n.name == "-" && inner.builtin == true && inner.name == "-" {
+			return inner.child
+		}
+	case *binaryExp:
+		if n.builtin == true {
+			return simplifyBinary(n)
+		}
+	case *lazyBinaryExp:
+		cond, ok := n.leftChild.(*valueExp)
+		if n.builtin == false || ok == false {
+			break
+		}
+		// the right operand is not evaluated
+		if n.name == "&&" && cond.value == 0 {
+			return &valueExp{value: 0.0}
+		}
+		if n.name == "||" && cond.value != 0 {
+			return &valueExp{value: 1.0}
+		}
+	case *lazyExp:
+		if n.builtin == false || n.name != "if" {
+			break
+		}
+		if cond, ok := n.children[0].(*valueExp); ok == true {
+			if cond.value != 0 {
+				return n.children[1]
+			}
+			return n.children[2]
+		}
+	}
+	return e
+}
+
+func simplifyBinary(e *binaryExp) Expression {
+	left, right := e.leftChild, e.rightChild
+	switch e.name {
+	case "+":
+		if isValue(right, 0) == true {
+			return left
+		}
+		if isValue(left, 0) == true {
+			return right
+		}
+	case "-":
+		if isValue(right, 0) == true {
+			return left
+		}
+	case "*":
+		if isValue(right, 1) == true {
+			return left
+		}
+		if isValue(left, 1) == true {
+			return right
+		}
+	case "/":
+		if isValue(right, 1) == true {
+			return left
+		}
+	case "^":
+		if isValue(right, 1) == true {
+			return left
+		}
+	}
+	return e
+}
+
+func isValue(e Expression, value float64) bool {
+	v, ok := e.(*valueExp)
+	return ok == true && v.value == value
+}
+
+// foldConstant evaluates e if all its children are values, like
+// pi() or 2 * 3. Only the nodes returned by Compile are folded: user
+// lazy functions, and Expression types it does not know, may look up
+// the Context.
+func foldConstant(e Expression) (Expression, bool) {
+	switch n := e.(type) {
+	case *unaryExp:
+		if n.impure == true {
+			return nil, false
+		}
+	case *binaryExp:
+		if n.impure == true {
+			return nil, false
+		}
+	case *nExp:
+		if n.impure == true {
+			return nil, false
+		}
+	case *lazyExp:
+		if n.builtin == false || n.impure == true {
+			return nil, false
+		}
+	case *lazyBinaryExp:
+		if n.builtin == false {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+	for _, c := range children(e) {
+		if _, ok := c.(*valueExp); ok == false {
+			return nil, false
+		}
+	}
+	v, err := e.Eval(nil)
+	if err != nil {
+		return nil, false
+	}
+	return &valueExp{value: v}, true
+}
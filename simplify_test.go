@@ -0,0 +1,149 @@
+package meval
+
+import (
+	"fmt"
+	"math"
+
+	. "gopkg.in/check.v1"
+)
+
+type SimplifySuite struct{}
+
+var _ = Suite(&SimplifySuite{})
+
+func (s *SimplifySuite) TestSimplify(c *C) {
+	c.Assert(RegisterFallibleFunction("positive", 1, func(a []float64) (float64, error) {
+		if a[0] <= 0 {
+			return math.NaN(), fmt.Errorf("%g is not positive", a[0])
+		}
+		return a[0], nil
+	}), IsNil)
+	defer UnregisterFunction("positive")
+
+	tests := []struct {
+		input, output string
+	}{
+		{"2 * pi() / 4", "1.5707963267948966"},
+		{"x * (3 - 2)", "x"},
+		{"1 * x + 0", "x"},
+		{"0 + x - 0", "x"},
+		{"(x / 1) ^ 1", "x"},
+		{"(x + y) ^ (2 - 2)", "(x + y) ^ 0"},
+		{"- -x", "x"},
+		{"+x * -(-y)", "x * y"},
+		{"-(2 * 3) + x", "-6 + x"},
+		// NaN-safe
+		{"0 * x", "0 * x"},
+		{"x * 0", "x * 0"},
+		{"x - x", "x - x"},
+		{"x / x", "x / x"},
+		// impure calls are kept
+		{"rand() * (1 + 1)", "rand() * 2"},
+		{"max(rand(), 2 * 2)", "max(rand(), 4)"},
+		// lazy built-ins
+		{"if(1 > 2, x, y + 0)", "y"},
+		{"if(2 > 1, x * 1, y)", "x"},
+		{"if(x, 1, 2)", "if(x, 1, 2)"},
+		{"if(1, 2, 3) + if(0, 2, 3)", "5"},
+		{"(1 < 0) && x", "0"},
+		{"(1 > 0) || x", "1"},
+		{"1 && x", "1 && x"},
+		{"x && 0", "x && 0"},
+		{"!(1 && 0) * x", "x"},
+		// evaluation errors are reported by Eval
+		{"positive(2 - 3) + positive(1 + 1)", "positive(-1) + 2"},
+	}
+	for _, t := range tests {
+		e, err := Compile(t.input)
+		c.Assert(err, IsNil, Commentf("input: %s", t.input))
+		before := format(e)
+		simplified := Simplify(e)
+		c.Check(format(simplified), Equals, t.output, Commentf("input: %s", t.input))
+		c.Check(format(e), Equals, before, Commentf("input: %s", t.input))
+	}
+}
+
+func mustCompile(c *C, input string) Expression {
+	e, err := Compile(input)
+	c.Assert(err, IsNil)
+	return e
+}
+
+func (s *SimplifySuite) TestSimplifiedEvaluatesTheSame(c *C) {
+	ctx := NewMapContext()
+	inputs := []string{
+		"x * 1 + 0 * y",
+		"(x + 0) ^ 1 - y / 1",
+		"x ^ 0 + y ^ (1 - 1)",
+		"if(0, x, y * 1) + -(-x)",
+		"(0 && x) + (1 || y)",
+	}
+	values := []float64{0, math.Copysign(0, -1), 1, -2.5, math.NaN(), math.Inf(1), math.Inf(-1)}
+	for _, input := range inputs {
+		e := mustCompile(c, input)
+		simplified := Simplify(e)
+		for _, x := range values {
+			for _, y := range values {
+				ctx.Add("x", NewValue(x))
+				ctx.Add("y", NewValue(y))
+				expected, err := e.Eval(ctx)
+				c.Assert(err, IsNil)
+				res, err := simplified.Eval(ctx)
+				c.Assert(err, IsNil)
+				if math.IsNaN(expected) == true {
+					c.Check(math.IsNaN(res), Equals, true, Commentf("%s with x=%g y=%g", input, x, y))
+				} else {
+					c.Check(res, Equals, expected, Commentf("%s with x=%g y=%g", input, x, y))
+				}
+			}
+		}
+	}
+}
+
+func (s *SimplifySuite) TestErrorsAreKept(c *C) {
+	for _, input := range []string{"undefined ^ 0", "undefined * 1 + 0", "1 / 1 * undefined"} {
+		simplified := Simplify(mustCompile(c, input))
+		_, err := simplified.Eval(nil)
+		c.Check(err, ErrorMatches, "'undefined' referenced, but no Context providen", Commentf("input: %s", input))
+	}
+	c.Check(format(Simplify(mustCompile(c, "x ^ 0 + 2 ^ 0"))), Equals, "x ^ 0 + 1")
+}
+
+func (s *SimplifySuite) TestUserOperatorsAreNotSimplified(c *C) {
+	l := NewEmptyLanguage()
+	c.Assert(l.RegisterOperator("+", 2, true, func(a []float64) float64 { return a[0] - a[1] }), IsNil)
+	c.Assert(l.RegisterLazyFunction("if", 3, func(args []Expression, ctx Context) (float64, error) {
+		return args[2].Eval(ctx)
+	}), IsNil)
+	e, err := l.Compile("if(1, x + 0, 2 + 1)")
+	c.Assert(err, IsNil)
+	c.Check(format(Simplify(e)), Equals, "if(1, x + 0, 1)")
+}
+
+// contextual is a user Expression without children, that evaluates
+// differently within a Context
+type contextual struct{}
+
+func (contextual) Eval(c Context) (float64, error) {
+	if c == nil {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+func (s *SimplifySuite) TestUnknownExpressionsAreNotFolded(c *C) {
+	e := Rewrite(mustCompile(c, "x + 2 * 3"), func(e Expression) Expression {
+		if _, ok := e.(*refExp); ok == true {
+			return contextual{}
+		}
+		return e
+	})
+	simplified := Simplify(e)
+	res, err := simplified.Eval(NewMapContext())
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, 7.0)
+	if n, ok := simplified.(*binaryExp); c.Check(ok, Equals, true) == true {
+		c.Check(n.leftChild, Equals, contextual{})
+		c.Check(n.rightChild, DeepEquals, &valueExp{value: 6})
+	}
+}
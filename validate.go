@@ -0,0 +1,206 @@
+package meval
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A ValidationError is returned by Validate and
+// MapContext.CompileAndAddAll, and lists all the problems found.
+type ValidationError struct {
+	Errors []error
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d validation error(s): %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the list of errors, so errors.Is and errors.As
+// inspects all of them.
+func (e *ValidationError) Unwrap() []error {
+	return e.Errors
+}
+
+// Validate statically checks e against c, without evaluating
+// anything. It reports every undefined variable and every cyclic
+// dependency that an evaluation could encounter, even in branches
+// that would not be taken. It returns nil or a *ValidationError.
+//
+// Malformed function calls are already rejected by Compile, see
+// MapContext.CompileAndAddAll to report them together.
+//
+// Variables bound by a LazyEvaluer, like the 'i' in 'sum(i, 1, 10,
+// i^2)', are reported as undefined if the Context does not define
+// them.
+func Validate(e Expression, c Context) error {
+	v := newValidator(c)
+	v.validateExpression(e, nil)
+	return v.result()
+}
+
+type validator struct {
+	c      Context
+	errors []error
+	// state of each variable: being visited (false), or visited
+	// (true)
+	state map[string]bool
+	// already reported cycles
+	cycles map[string]bool
+	// variables whose problems are already reported
+	ignored map[string]bool
+}
+
+func newValidator(c Context) *validator {
+	return &validator{
+		c:       c,
+		state:   make(map[string]bool),
+		cycles:  make(map[string]bool),
+		ignored: make(map[string]bool),
+	}
+}
+
+func (v *validator) result() error {
+	if len(v.errors) == 0 {
+		return nil
+	}
+	return &ValidationError{Errors: v.errors}
+}
+
+func (v *validator) report(chain []string, err error) {
+	if len(chain) > 0 {
+		err = &EvalError{
+			Chain: append([]string(nil), chain...),
+			Err:   err,
+		}
+	}
+	v.errors = append(v.errors, err)
+}
+
+// validateExpression checks e, reached through the chain of
+// variables.
+func (v *validator) validateExpression(e Expression, chain []string) {
+	for _, name := range Dependencies(e) {
+		v.validateVariable(name, chain)
+	}
+}
+
+func (v *validator) validateVariable(name string, chain []string) {
+	if v.ignored[name] == true {
+		return
+	}
+	if v.c == nil {
+		v.report(chain, &NoContextError{Name: name})
+		return
+	}
+
+	if done, seen := v.state[name]; seen == true {
+		if done == false {
+			v.reportCycle(name, chain)
+		}
+		return
+	}
+
+	e, err := v.c.GetExpression(name)
+	if err != nil {
+		v.state[name] = true
+		v.report(chain, err)
+		return
+	}
+
+	v.state[name] = false
+	v.validateExpression(e, append(chain, name))
+	v.state[name] = true
+}
+
+func (v *validator) reportCycle(name string, chain []string) {
+	start := len(chain) - 1
+	for ; start >= 0 && chain[start] != name; start-- {
+	}
+	cycle := append(append([]string(nil), chain[start:]...), name)
+
+	// the same cycle could be reached from any of its variables
+	key := canonicalCycle(cycle)
+	if v.cycles[key] == true {
+		return
+	}
+	v.cycles[key] = true
+	v.report(chain[:start], &CyclicDependencyError{Cycle: cycle})
+}
+
+// canonicalCycle returns a representation of cycle that does not
+// depend on its starting point
+func canonicalCycle(cycle []string) string {
+	nodes := cycle[:len(cycle)-1]
+	min := 0
+	for i, n := range nodes {
+		if n < nodes[min] {
+			min = i
+		}
+	}
+	rotated := append(append([]string(nil), nodes[min:]...), nodes[:min]...)
+	return strings.Join(rotated, " -> ")
+}
+
+// Validate statically checks all the expressions of the MapContext,
+// like the package function Validate does. It returns nil or a
+// *ValidationError.
+func (c *MapContext) Validate() error {
+	v := newValidator(c)
+	for _, name := range sortedNames(c.exprs) {
+		v.validateVariable(name, nil)
+	}
+	return v.result()
+}
+
+// CompileAndAddAll compiles and validates a set of definitions, and
+// adds them to the MapContext only if they are all valid. Otherwise
+// it returns a *ValidationError listing every compilation error,
+// like a malformed function call, with every problem Validate would
+// report for the definitions, and the MapContext is left unchanged.
+// Compilation errors are wrapped in an *EvalError naming the
+// definition.
+func (c *MapContext) CompileAndAddAll(defs map[string]string) error {
+	names := make([]string, 0, len(defs))
+	for name := range defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	scope := NewScopeContext(c)
+	v := newValidator(scope)
+	for _, name := range names {
+		e, err := Compile(defs[name])
+		if err != nil {
+			v.report([]string{name}, err)
+			v.ignored[name] = true
+			continue
+		}
+		scope.Add(name, e)
+	}
+	for _, name := range names {
+		v.validateVariable(name, nil)
+	}
+	if err := v.result(); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := c.Add(name, scope.locals[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedNames(exprs map[string]Expression) []string {
+	names := make(map[string]bool, len(exprs))
+	for name := range exprs {
+		names[name] = true
+	}
+	return sortedKeys(names)
+}
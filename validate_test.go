@@ -0,0 +1,119 @@
+package meval
+
+import (
+	"errors"
+
+	. "gopkg.in/check.v1"
+)
+
+type ValidateSuite struct{}
+
+var _ = Suite(&ValidateSuite{})
+
+func (s *ValidateSuite) TestValidExpression(c *C) {
+	ctx := NewMapContext()
+	c.Assert(ctx.CompileAndAdd("a", "2 * b"), IsNil)
+	c.Assert(ctx.CompileAndAdd("b", "max(1, 2, 3)"), IsNil)
+
+	e, err := Compile("a + b")
+	c.Assert(err, IsNil)
+	c.Check(Validate(e, ctx), IsNil)
+	c.Check(ctx.Validate(), IsNil)
+
+	e, err = Compile("1 + 2")
+	c.Assert(err, IsNil)
+	c.Check(Validate(e, nil), IsNil)
+}
+
+func (s *ValidateSuite) TestReportsAllProblems(c *C) {
+	ctx := NewMapContext()
+	defs := map[string]string{
+		"a": "b + c + if(1, 2, undefined1)",
+		"b": "d * undefined2",
+		"c": "a + e",
+		"d": "2",
+		"e": "f",
+		"f": "e + undefined1",
+	}
+	for name, input := range defs {
+		c.Assert(ctx.CompileAndAdd(name, input), IsNil)
+	}
+
+	e, err := Compile("a")
+	c.Assert(err, IsNil)
+
+	err = Validate(e, ctx)
+	c.Assert(err, Not(IsNil))
+	verr, ok := err.(*ValidationError)
+	c.Assert(ok, Equals, true)
+
+	messages := make([]string, len(verr.Errors))
+	for i, err := range verr.Errors {
+		messages[i] = err.Error()
+	}
+	c.Check(messages, DeepEquals, []string{
+		"in a -> b: Could not find 'undefined2' in MapContext",
+		"Got cyclic dependency a -> c -> a",
+		"in a -> c: Got cyclic dependency e -> f -> e",
+		"in a -> c -> e -> f: Could not find 'undefined1' in MapContext",
+	})
+
+	var cerr *CyclicDependencyError
+	c.Check(errors.As(err, &cerr), Equals, true)
+	var uerr *UndefinedVariableError
+	c.Check(errors.As(err, &uerr), Equals, true)
+
+	// validating the whole context reports the same problems, once
+	err = ctx.Validate()
+	c.Assert(err, Not(IsNil))
+	c.Check(len(err.(*ValidationError).Errors), Equals, 4)
+}
+
+func (s *ValidateSuite) TestCompileAndAddAll(c *C) {
+	ctx := NewMapContext()
+	c.Assert(ctx.CompileAndAdd("gain", "2"), IsNil)
+
+	err := ctx.CompileAndAddAll(map[string]string{
+		"a": "1 + sin(x, 2)",
+		"b": "a * gain + undefined",
+		"c": "max() + d",
+		"d": "c",
+		"e": "2 *",
+	})
+	c.Assert(err, Not(IsNil))
+	verr, ok := err.(*ValidationError)
+	c.Assert(ok, Equals, true)
+	messages := make([]string, len(verr.Errors))
+	for i, err := range verr.Errors {
+		messages[i] = err.Error()
+	}
+	c.Check(messages, DeepEquals, []string{
+		"in a: 1:5: 'sin()' expects 1 argument, got 2",
+		"in c: 1:1: 'max()' expects at least 1 argument, got 0",
+		"in e: 1:4: Unexpected end of input",
+		"in b: Could not find 'undefined' in MapContext",
+	})
+	var aerr *ArityError
+	c.Check(errors.As(err, &aerr), Equals, true)
+	var perr *ParseError
+	c.Check(errors.As(err, &perr), Equals, true)
+	// nothing is added
+	_, err = ctx.GetExpression("d")
+	c.Check(err, Not(IsNil))
+
+	err = ctx.CompileAndAddAll(map[string]string{
+		"a": "b + gain",
+		"b": "a",
+	})
+	c.Check(err, ErrorMatches, "1 validation error\\(s\\): Got cyclic dependency a -> b -> a")
+
+	c.Assert(ctx.CompileAndAddAll(map[string]string{
+		"a": "b + gain",
+		"b": "3",
+	}), IsNil)
+	e, err := Compile("a")
+	c.Assert(err, IsNil)
+	res, err := e.Eval(ctx)
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, 5.0)
+}